@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultFrameDelay = 500 * time.Millisecond
+
+// animationT is a sequence of captures to be assembled into an animated image.
+type animationT struct {
+	// Captures have absolute paths, and are in time order
+	Captures []captureRecordT
+	Delay    time.Duration
+	// Overlay stamps each frame with its time and the time elapsed since the first frame
+	Overlay bool
+}
+
+func runAnimate(args []string) error {
+	var q indexQueryFlagsT
+	var flagGlob, flagOut string
+	animation := animationT{}
+	fs := newSubcommandFlagSet("animate", "")
+	q.register(fs)
+	fs.StringVar(&flagGlob, "glob", "",
+		"Animate the captures matching this file pattern (e.g. \"scope_captures/drift_*.png\") instead of querying the index")
+	fs.StringVar(&flagOut, "o", "",
+		"Output path. A \".gif\" extension makes an animated GIF and \".png\" an APNG (Defaults to animation_{date}_{time}.gif in the index directory)")
+	fs.DurationVar(&animation.Delay, "delay", defaultFrameDelay, "Time each frame is shown")
+	fs.BoolVar(&animation.Overlay, "overlay", true, "Stamp each frame with its time and the elapsed time")
+	if positional := parseInterspersed(fs, args); len(positional) > 0 {
+		return fmt.Errorf("unexpected argument %q", positional[0])
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+
+	var err error
+	if flagGlob != "" {
+		animation.Captures, err = capturesFromGlob(flagGlob)
+	} else {
+		animation.Captures, err = capturesFromIndex(q)
+	}
+	if err != nil {
+		return err
+	}
+
+	if flagOut == "" {
+		indexDir, err := indexDirForOutputDir(outputDirTemplate(q.outputDir))
+		if err != nil {
+			return err
+		}
+		flagOut = filepath.Join(indexDir, "animation_"+time.Now().Format("2006-01-02_15-04-05")+".gif")
+	}
+	return animation.write(flagOut)
+}
+
+// write assembles the animation and writes it to path, in the format given by its extension.
+func (a animationT) write(path string) error {
+	if len(a.Captures) < 2 {
+		return fmt.Errorf("an animation needs at least 2 captures (got %d)", len(a.Captures))
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".gif" && ext != ".png" {
+		return fmt.Errorf("unsupported animation format %q (expected .gif or .png)", ext)
+	}
+	log.InfoPrintf("Animating %d capture(s)...", len(a.Captures))
+
+	frames := []*image.RGBA{}
+	start := a.Captures[0].Time
+	for _, capture := range a.Captures {
+		img, err := decodeImageFile(capture.Path)
+		if err != nil {
+			return err
+		}
+		// Every frame must be the size of the first
+		if len(frames) > 0 && img.Bounds().Size() != frames[0].Bounds().Size() {
+			return fmt.Errorf("%q is %dx%d, but the first capture is %dx%d", capture.Path, img.Bounds().Dx(),
+				img.Bounds().Dy(), frames[0].Bounds().Dx(), frames[0].Bounds().Dy())
+		}
+		frame := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(frame, frame.Bounds(), img, img.Bounds().Min, draw.Src)
+		if a.Overlay && !capture.Time.IsZero() {
+			// Match the theme the capture was annotated with
+			theme, err := lookupTheme(capture.Theme)
+			if err != nil {
+				theme, _ = lookupTheme("")
+			}
+			addFrameOverlay(frame, capture.Time, capture.Time.Sub(start), theme)
+		}
+		frames = append(frames, frame)
+	}
+
+	var data []byte
+	var err error
+	if ext == ".gif" {
+		data, err = encodeGIF(frames, a.Delay)
+	} else {
+		data, err = encodeAPNG(frames, a.Delay)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeDerivedImage(path, data, kindAnimation); err != nil {
+		return err
+	}
+	log.InfoPrintf("Wrote animation to %q.", path)
+	return nil
+}
+
+// addFrameOverlay replaces the capture timestamp with the frame's time of day and the time
+// elapsed since the first frame, which is more useful when watching a sequence. It is drawn in
+// the theme's colors.
+func addFrameOverlay(frame *image.RGBA, timestamp time.Time, elapsed time.Duration, theme *themeT) {
+	origin := layoutForImage(frame, "").TimestampOrigin
+	// Two lines of ten characters
+	area := image.Rect(origin.X, origin.Y, origin.X+10*8, origin.Y+2*13+4)
+	draw.Draw(frame, area, &image.Uniform{theme.Background}, image.Point{}, draw.Src)
+	elapsed = elapsed.Round(time.Second)
+	timestampColor := theme.Annotation(colorTimestamp)
+	addLabel(frame, timestamp.Format("15:04:05"), origin.X, origin.Y, timestampColor)
+	addLabel(frame, fmt.Sprintf("+%d:%02d:%02d", int(elapsed.Hours()), int(elapsed.Minutes())%60,
+		int(elapsed.Seconds())%60), origin.X, origin.Y+13, timestampColor)
+}
+
+// scopePalette returns a palette for frames: the trace and annotation colors first, then the
+// most common remaining colors in the frames. Scope screens use few colors, so this is usually
+// exact.
+func scopePalette(frames []*image.RGBA) color.Palette {
+	palette := color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}, colorTimestamp, colorNote}
+	sources := []string{}
+	for source := range colorSources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		palette = append(palette, sourceColor(source))
+	}
+	inPalette := map[color.RGBA]bool{}
+	for _, c := range palette {
+		inPalette[color.RGBAModel.Convert(c).(color.RGBA)] = true
+	}
+
+	counts := map[color.RGBA]int{}
+	for _, frame := range frames {
+		for i := 0; i < len(frame.Pix); i += 4 {
+			counts[color.RGBA{frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], 255}]++
+		}
+	}
+	common := []color.RGBA{}
+	for c := range counts {
+		if !inPalette[c] {
+			common = append(common, c)
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		if counts[common[i]] != counts[common[j]] {
+			return counts[common[i]] > counts[common[j]]
+		}
+		// Break ties deterministically
+		a, b := common[i], common[j]
+		return uint32(a.R)<<16|uint32(a.G)<<8|uint32(a.B) < uint32(b.R)<<16|uint32(b.G)<<8|uint32(b.B)
+	})
+	for _, c := range common {
+		if len(palette) == 256 {
+			break
+		}
+		palette = append(palette, c)
+	}
+	return palette
+}
+
+func encodeGIF(frames []*image.RGBA, delay time.Duration) ([]byte, error) {
+	palette := scopePalette(frames)
+	animation := &gif.GIF{}
+	for _, frame := range frames {
+		paletted := image.NewPaletted(frame.Bounds(), palette)
+		// No dithering: it would turn flat areas and thin traces into noise
+		draw.Draw(paletted, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+		animation.Image = append(animation.Image, paletted)
+		// GIF delays are 16 bit counts of centiseconds
+		animation.Delay = append(animation.Delay, int(min(delay/(10*time.Millisecond), math.MaxUint16)))
+	}
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, animation); err != nil {
+		return nil, fmt.Errorf("failed to encode GIF: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// encodeAPNG encodes frames as an animated PNG. Each frame is encoded as a PNG by image/png, and
+// its image data is then repackaged: the first frame's IDAT chunks are kept (so that viewers
+// without APNG support show it), and later frames' become fdAT chunks. Every frame shares the
+// first's IHDR, so they must all be the same size, and are made opaque so that image/png gives
+// them all the same color type.
+func encodeAPNG(frames []*image.RGBA, delay time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	sequence := uint32(0)
+	var ihdr []byte
+	for i, frame := range frames {
+		if frame.Bounds().Size() != frames[0].Bounds().Size() {
+			return nil, fmt.Errorf("frame %d is %dx%d, but the first frame is %dx%d", i+1, frame.Bounds().Dx(),
+				frame.Bounds().Dy(), frames[0].Bounds().Dx(), frames[0].Bounds().Dy())
+		}
+		opaque := image.NewRGBA(image.Rect(0, 0, frame.Bounds().Dx(), frame.Bounds().Dy()))
+		draw.Draw(opaque, opaque.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+		draw.Draw(opaque, opaque.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, opaque); err != nil {
+			return nil, fmt.Errorf("failed to encode PNG: %v", err)
+		}
+		pngData := encoded.Bytes()
+		offset := len(pngSignature)
+		firstIDAT := true
+		for offset < len(pngData) {
+			end, err := pngChunkEnd(pngData, offset)
+			if err != nil {
+				return nil, err
+			}
+			chunkType := string(pngData[offset+4 : offset+8])
+			chunkData := pngData[offset+8 : end-4]
+			switch {
+			case chunkType == "IHDR" && i > 0:
+				if !bytes.Equal(chunkData, ihdr) {
+					return nil, fmt.Errorf("frame %d doesn't have the same PNG header as the first", i+1)
+				}
+			case chunkType == "IHDR":
+				ihdr = chunkData
+				out.Write(pngData[offset:end])
+				acTL := make([]byte, 8)
+				binary.BigEndian.PutUint32(acTL[0:], uint32(len(frames)))
+				binary.BigEndian.PutUint32(acTL[4:], 0) // Loop forever
+				writePNGChunk(&out, "acTL", acTL)
+			case chunkType == "IDAT":
+				if firstIDAT {
+					writePNGChunk(&out, "fcTL", frameControl(sequence, frame.Bounds().Size(), delay))
+					sequence++
+					firstIDAT = false
+				}
+				if i == 0 {
+					writePNGChunk(&out, "IDAT", chunkData)
+				} else {
+					fdAT := binary.BigEndian.AppendUint32(nil, sequence)
+					writePNGChunk(&out, "fdAT", append(fdAT, chunkData...))
+					sequence++
+				}
+			}
+			offset = end
+		}
+	}
+	writePNGChunk(&out, "IEND", nil)
+	return out.Bytes(), nil
+}
+
+// frameControl returns the data of an APNG fcTL chunk for a full size frame.
+func frameControl(sequence uint32, size image.Point, delay time.Duration) []byte {
+	data := binary.BigEndian.AppendUint32(nil, sequence)
+	data = binary.BigEndian.AppendUint32(data, uint32(size.X))
+	data = binary.BigEndian.AppendUint32(data, uint32(size.Y))
+	data = binary.BigEndian.AppendUint32(data, 0) // x offset
+	data = binary.BigEndian.AppendUint32(data, 0) // y offset
+	numerator, denominator := apngDelay(delay)
+	data = binary.BigEndian.AppendUint16(data, numerator)
+	data = binary.BigEndian.AppendUint16(data, denominator)
+	// Dispose op none, blend op source
+	return append(data, 0, 0)
+}
+
+// apngDelay returns an APNG frame delay as a 16 bit fraction of a second: in milliseconds if it
+// fits, otherwise in centiseconds or seconds, and at most 65535 seconds.
+func apngDelay(delay time.Duration) (numerator, denominator uint16) {
+	for _, unit := range []time.Duration{time.Millisecond, 10 * time.Millisecond, time.Second} {
+		if delay/unit <= math.MaxUint16 {
+			return uint16(delay / unit), uint16(time.Second / unit)
+		}
+	}
+	return math.MaxUint16, 1
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pngChunkT is a chunk of an encoded PNG.
+type pngChunkT struct {
+	Type string
+	Data []byte
+}
+
+// readPNGChunks splits an encoded PNG into its chunks, checking their CRCs.
+func readPNGChunks(t *testing.T, pngData []byte) []pngChunkT {
+	t.Helper()
+	chunks := []pngChunkT{}
+	for offset := len(pngSignature); offset < len(pngData); {
+		end, err := pngChunkEnd(pngData, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := pngChunkT{Type: string(pngData[offset+4 : offset+8]), Data: pngData[offset+8 : end-4]}
+		if crc32.ChecksumIEEE(pngData[offset+4:end-4]) != binary.BigEndian.Uint32(pngData[end-4:end]) {
+			t.Errorf("%s chunk has a bad CRC", chunk.Type)
+		}
+		chunks = append(chunks, chunk)
+		offset = end
+	}
+	return chunks
+}
+
+// testFrame returns a frame filled with one color.
+func testFrame(width, height int, c color.RGBA) *image.RGBA {
+	frame := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(frame.Pix); i += 4 {
+		frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], frame.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return frame
+}
+
+func TestEncodeAPNG(t *testing.T) {
+	frames := []*image.RGBA{
+		testFrame(8, 6, color.RGBA{247, 250, 82, 255}),
+		// A transparent frame must still get the same color type as the others
+		testFrame(8, 6, color.RGBA{0, 0, 0, 0}),
+		testFrame(8, 6, color.RGBA{0, 225, 221, 255}),
+	}
+	data, err := encodeAPNG(frames, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks are IHDR, acTL, then for each frame an fcTL followed by its image data (IDAT
+	// for the first frame, fdAT for the others), then IEND
+	types := []string{}
+	sequence := uint32(0)
+	for _, chunk := range readPNGChunks(t, data) {
+		if last := len(types) - 1; last < 0 || chunk.Type != types[last] || chunk.Type == "fcTL" {
+			// A frame's image data may be split over several chunks
+			types = append(types, chunk.Type)
+		}
+		switch chunk.Type {
+		case "IHDR":
+			if width, height := binary.BigEndian.Uint32(chunk.Data[0:]), binary.BigEndian.Uint32(chunk.Data[4:]); width != 8 || height != 6 {
+				t.Errorf("IHDR is %dx%d, want 8x6", width, height)
+			}
+		case "acTL":
+			if frames, plays := binary.BigEndian.Uint32(chunk.Data[0:]), binary.BigEndian.Uint32(chunk.Data[4:]); frames != 3 || plays != 0 {
+				t.Errorf("acTL has %d frames and %d plays, want 3 frames and 0 (forever)", frames, plays)
+			}
+		case "fcTL", "fdAT":
+			// fcTL and fdAT chunks share one sequence of numbers, starting at 0
+			if got := binary.BigEndian.Uint32(chunk.Data); got != sequence {
+				t.Errorf("%s has sequence number %d, want %d", chunk.Type, got, sequence)
+			}
+			sequence++
+		}
+		if chunk.Type == "fcTL" {
+			if len(chunk.Data) != 26 {
+				t.Fatalf("fcTL is %d bytes, want 26", len(chunk.Data))
+			}
+			width, height := binary.BigEndian.Uint32(chunk.Data[4:]), binary.BigEndian.Uint32(chunk.Data[8:])
+			numerator, denominator := binary.BigEndian.Uint16(chunk.Data[20:]), binary.BigEndian.Uint16(chunk.Data[22:])
+			if width != 8 || height != 6 || numerator != 200 || denominator != 1000 {
+				t.Errorf("fcTL is %dx%d for %d/%ds, want 8x6 for 200/1000s", width, height, numerator, denominator)
+			}
+		}
+	}
+	want := []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "fcTL", "fdAT", "IEND"}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("chunks are %v, want %v", types, want)
+	}
+
+	// Viewers without APNG support show the first frame
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.RGBAModel.Convert(img.At(0, 0)); got != (color.RGBA{247, 250, 82, 255}) {
+		t.Errorf("the default image is %v, want the first frame", got)
+	}
+}
+
+func TestEncodeAPNGFrameSizes(t *testing.T) {
+	frames := []*image.RGBA{testFrame(8, 6, color.RGBA{A: 255}), testFrame(6, 8, color.RGBA{A: 255})}
+	if _, err := encodeAPNG(frames, time.Second); err == nil {
+		t.Errorf("encodeAPNG() of frames of different sizes didn't fail")
+	}
+}
+
+func TestAPNGDelay(t *testing.T) {
+	tests := []struct {
+		delay       time.Duration
+		numerator   uint16
+		denominator uint16
+	}{
+		{0, 0, 1000},
+		{200 * time.Millisecond, 200, 1000},
+		{65535 * time.Millisecond, 65535, 1000},
+		{65536 * time.Millisecond, 6553, 100},
+		{5 * time.Minute, 30000, 100},
+		{time.Hour, 3600, 1},
+		{100 * time.Hour, 65535, 1},
+	}
+	for _, test := range tests {
+		numerator, denominator := apngDelay(test.delay)
+		if numerator != test.numerator || denominator != test.denominator {
+			t.Errorf("apngDelay(%v) = %d/%d, want %d/%d", test.delay, numerator, denominator, test.numerator, test.denominator)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runAnnotate (re-)annotates an existing raw capture, so that e.g. a typo in a label can be
+// fixed without capturing again. The capture time, instrument and settings come from the
+// capture's metadata; the note and labels do too, unless they are given on the command line.
+func runAnnotate(args []string) error {
+	var flagOut, flagNote, flagFormat, flagTheme, flagPalette, flagDrawingsFile string
+	var flagCrop, flagScaler string
+	var flagScale float64
+	var flagMarkers bool
+	var flagChannelLabels [maxAnalogChannel]string
+	var flagLabels labelsFlag
+	var flagDrawings drawingsFlag
+	fs := newSubcommandFlagSet("annotate", "RAW_IMAGE")
+	fs.StringVar(&flagOut, "o", "",
+		"Output path (Defaults to the raw image's name without \".raw\", e.g. shot.raw.png -> shot.png, otherwise NAME_annotated)")
+	fs.StringVar(&flagNote, "note", "", "Note to add to the image (Defaults to the original note)")
+	fs.StringVar(&flagNote, "n", "", "Note to add to the image (Defaults to the original note)")
+	for i := range flagChannelLabels {
+		usage := fmt.Sprintf("Channel %d label", i+1)
+		fs.StringVar(&flagChannelLabels[i], fmt.Sprintf("label%d", i+1), "", usage)
+		fs.StringVar(&flagChannelLabels[i], fmt.Sprintf("l%d", i+1), "", usage)
+	}
+	fs.Var(&flagLabels, "label",
+		"Source label as SOURCE=TEXT, replacing the original label for the source (SOURCE= removes it). May be repeated.")
+	fs.StringVar(&flagFormat, "format", "",
+		fmt.Sprintf("Output image format: %s (Defaults to the -o extension, then png)", formatNames()))
+	fs.StringVar(&flagTheme, "theme", "", fmt.Sprintf("Color theme: %s (Defaults to the original theme)", themeNames()))
+	fs.StringVar(&flagPalette, "palette", "", fmt.Sprintf("Annotation color palette: %s", paletteNames()))
+	fs.BoolVar(&flagMarkers, "markers", false, "Draw a line style marker next to each label")
+	fs.Var(&flagDrawings, "draw", "Draw an arrow, rect, circle or text callout (as for capturing). May be repeated.")
+	fs.StringVar(&flagDrawingsFile, "drawings", "", "JSON or YAML file of drawings to add")
+	fs.StringVar(&flagCrop, "crop", fullRegion,
+		fmt.Sprintf("Crop the annotated image to a region: %s", regionNames(layouts[defaultLayoutName])))
+	fs.Float64Var(&flagScale, "scale", 1, "Scale the annotated image by this factor")
+	fs.StringVar(&flagScaler, "scaler", "auto", "Scaling method: nearest, smooth or auto")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one raw image")
+	}
+	rawPath := positional[0]
+	if err := startup(); err != nil {
+		return err
+	}
+	if flagPalette != "" {
+		config.Palette = flagPalette
+	}
+	if err := checkPalette(config.Palette); err != nil {
+		return err
+	}
+	if flagMarkers {
+		config.Markers = true
+	}
+	view := viewT{Region: strings.ToLower(flagCrop), Scale: flagScale, Scaler: strings.ToLower(flagScaler)}
+	if err := checkView(view); err != nil {
+		return err
+	}
+
+	img, record, err := readRawCapture(rawPath)
+	if err != nil {
+		return err
+	}
+
+	// Command line values replace the original ones
+	if flagNote != "" {
+		record.Note = flagNote
+	}
+	record.Labels = replaceLabels(record.Labels, flagChannelLabels[:], flagLabels)
+	if flagTheme != "" {
+		record.Theme = flagTheme
+	}
+	theme, err := lookupTheme(record.Theme)
+	if err != nil {
+		return err
+	}
+	if flagDrawingsFile != "" {
+		fileDrawings, err := loadDrawings(flagDrawingsFile)
+		if err != nil {
+			return err
+		}
+		record.Drawings = append(record.Drawings, fileDrawings...)
+	}
+	record.Drawings = append(record.Drawings, flagDrawings...)
+	record.Variants = nil
+
+	// Choose the output path and format
+	outPath := flagOut
+	if outPath == "" {
+		outPath = annotatedPath(rawPath)
+	}
+	fileType, err := selectFormat(flagFormat, outPath)
+	if err != nil {
+		return err
+	}
+	if flagOut == "" {
+		ext := filepath.Ext(outPath)
+		outPath = strings.TrimSuffix(outPath, ext) + "." + imageFormats[fileType].Ext
+		if !strings.HasSuffix(strings.TrimSuffix(rawPath, filepath.Ext(rawPath)), ".raw") {
+			// Don't overwrite anything other than the raw image's own annotated version
+			if outPath, err = allocateOutputFile(outPath, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.InfoPrint("Annotating scope capture...")
+	// Annotate using the layout of the scope the capture was made with
+	layout := layoutForImage(img, record.Layout)
+	record.Layout = layout.Name
+	annotated := addLabelsToImage(img, layout, record.Time, record.Note, record.Labels, theme, config.Markers)
+	if err := addDrawings(annotated, layout, record.Drawings, record.Settings, theme); err != nil {
+		return err
+	}
+	options := captureOptionsT{FileType: fileType, Encode: encodeOptionsT{JPEGQuality: defaultJPEGQuality}}
+	outData, err := writeAnnotatedImage(outPath, view.apply(annotated, layout), record, options)
+	if err != nil {
+		return err
+	}
+	log.InfoPrintf("Wrote annotated scope capture to %q.", outPath)
+
+	// Keep the index (if the image is in an indexed directory) up to date. The index directory
+	// is absolute, so the path must be too for the entry to be made relative to it.
+	absPath, err := filepath.Abs(outPath)
+	if err != nil {
+		return err
+	}
+	record.Path = absPath
+	record.SHA256 = sha256Hex(outData)
+	if indexDir, ok := findIndexDir(absPath); ok {
+		return appendToIndex(indexDir, record)
+	}
+	return nil
+}
+
+// readRawCapture decodes a raw capture and reads its metadata. If it has none then the file's
+// modification time is used as the capture time.
+func readRawCapture(path string) (image.Image, captureRecordT, error) {
+	img, err := readCaptureImage(path)
+	if err != nil {
+		return nil, captureRecordT{}, err
+	}
+	record, ok, err := readCaptureMetadata(path)
+	if err != nil {
+		log.InfoPrintf("WARNING: Unable to read metadata from %q: %v", path, err)
+	}
+	if !ok {
+		log.InfoPrintf("WARNING: %q has no capture metadata; using its modification time.", path)
+		record = captureRecordT{Session: sessionID, Host: config.Hostname, Project: config.Project}
+		if info, err := os.Stat(path); err == nil {
+			record.Time = info.ModTime()
+		}
+	}
+	return img, record, nil
+}
+
+// readCaptureImage decodes an image file, correcting PNG checksums first (as when capturing).
+func readCaptureImage(path string) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		if data, err = FixPNGChecksum(data); err != nil {
+			return nil, fmt.Errorf("failed to fix PNG checksum of %q: %v", path, err)
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %v", path, err)
+	}
+	return img, nil
+}
+
+// replaceLabels applies command line labels to a capture's original labels. -l1..-l4 and
+// -label replace the original label for their source, and an empty -label removes it.
+func replaceLabels(original []labelT, channelLabels []string, labels []labelT) []labelT {
+	replaced := append([]labelT{}, original...)
+	for i, text := range channelLabels {
+		if text != "" {
+			labels = append([]labelT{{Source: fmt.Sprintf("CH%d", i+1), Text: text}}, labels...)
+		}
+	}
+	// mergeLabels lets later labels win, and drops empty ones
+	return mergeLabels(nil, append(replaced, labels...))
+}
+
+// annotatedPath returns the default output path for annotating rawPath: "shot.raw.png" becomes
+// "shot.png", and anything else "NAME_annotated.png".
+func annotatedPath(rawPath string) string {
+	ext := filepath.Ext(rawPath)
+	stem := strings.TrimSuffix(rawPath, ext)
+	if strings.HasSuffix(stem, ".raw") {
+		return strings.TrimSuffix(stem, ".raw") + ext
+	}
+	return stem + "_annotated" + ext
+}
+
+// findIndexDir returns the directory holding the index which covers path: the nearest of its
+// parent directories containing an index.
+func findIndexDir(path string) (string, bool) {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return "", false
+	}
+	for {
+		if fileExists(filepath.Join(dir, indexFilename)) {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			log.InfoPrint("No index found, so the index has not been updated.")
+			return "", false
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultCheckLimit is the percentage of the graticule's pixels which may differ from the
+// golden image before a check fails.
+const defaultCheckLimit = 0.5
+
+// checkT describes the tests made by the check subcommand.
+type checkT struct {
+	// Golden is the golden image the graticule is compared with, if any
+	Golden    string
+	Limit     float64
+	Threshold int
+	// Masks are tested against the scope's waveforms, if any
+	Masks []maskT
+	// DiffPath and MaskPath are where the golden image diff and the annotated mask test image are
+	// written
+	DiffPath string
+	MaskPath string
+}
+
+// runCheck captures the scope screen and/or waveforms, for production testing. The graticule is
+// compared with a golden (reference) capture, and the waveforms are tested against masks. If
+// any test fails then so does the check (so the app exits non-zero).
+func runCheck(args []string) error {
+	var flagMask, flagGoldenWaveforms, flagTolerance, flagTimeTolerance, flagSaveMask string
+	var flagScopeFormat, flagRecipe string
+	var scope scopeFlagsT
+	check := checkT{}
+	fs := newSubcommandFlagSet("check", "")
+	fs.StringVar(&check.Golden, "golden", "", "The golden (reference) capture to compare the screen with, ideally a raw capture")
+	fs.Float64Var(&check.Limit, "limit", defaultCheckLimit,
+		"-golden: the check fails if more than this percentage of the graticule's pixels differ")
+	fs.IntVar(&check.Threshold, "threshold", defaultDiffThreshold,
+		"-golden: the smallest change in a pixel's red, green or blue (0-255) which counts as changed")
+	fs.StringVar(&check.DiffPath, "diff", "",
+		"-golden: where to write the diff image if the check fails (Defaults to check_{date}_{time}_diff.png in the index directory)")
+	fs.StringVar(&flagMask, "mask", "",
+		"Mask CSV (time_s, then CHn_lower_V and/or CHn_upper_V columns) to test the waveforms against")
+	fs.StringVar(&flagGoldenWaveforms, "golden-waveforms", "",
+		"Waveform CSV (as saved with -waveforms) to derive masks from, using -tolerance and -time-tolerance")
+	fs.StringVar(&flagTolerance, "tolerance", "0.1V", "-golden-waveforms: how far (V) the waveforms may be from the golden waveforms")
+	fs.StringVar(&flagTimeTolerance, "time-tolerance", "0s", "-golden-waveforms: how far (s) edges may move")
+	fs.StringVar(&flagSaveMask, "save-mask", "", "-golden-waveforms: also save the derived masks to this CSV file")
+	fs.StringVar(&check.MaskPath, "mask-image", "",
+		"Where to write the annotated capture showing the masks (Defaults to check_{date}_{time}_mask.png in the index directory)")
+	scope.register(fs)
+	fs.StringVar(&flagRecipe, "recipe", "", "JSON or YAML recipe of scope settings and measurements to apply (and verify) before checking")
+	fs.StringVar(&flagScopeFormat, "scope-format", "",
+		"Image format to request from the scope: png, bmp24, bmp8 or jpeg (Defaults per model, then png)")
+	if positional := parseInterspersed(fs, args); len(positional) > 0 {
+		return fmt.Errorf("unexpected argument %q", positional[0])
+	}
+	if check.Golden == "" && flagMask == "" && flagGoldenWaveforms == "" {
+		fs.Usage()
+		return fmt.Errorf("-golden, -mask or -golden-waveforms is required")
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+	if _, err := selectScopeFormat(flagScopeFormat, ""); err != nil {
+		return err
+	}
+
+	var recipe *recipeT
+	if flagRecipe != "" {
+		var err error
+		if recipe, err = loadRecipe(flagRecipe); err != nil {
+			return err
+		}
+	}
+
+	// Load the masks
+	if flagMask != "" {
+		masks, err := readMasks(flagMask)
+		if err != nil {
+			return err
+		}
+		check.Masks = append(check.Masks, masks...)
+	}
+	if flagGoldenWaveforms != "" {
+		masks, err := goldenWaveformMasks(flagGoldenWaveforms, flagTolerance, flagTimeTolerance)
+		if err != nil {
+			return err
+		}
+		if flagSaveMask != "" {
+			if err := writeFileAtomic(flagSaveMask, maskCSV(masks)); err != nil {
+				return err
+			}
+			log.InfoPrintf("Wrote masks to %q.", flagSaveMask)
+		}
+		check.Masks = append(check.Masks, masks...)
+	}
+
+	// Default the output paths
+	stem := "check_" + time.Now().Format("2006-01-02_15-04-05")
+	if check.Golden != "" && check.DiffPath == "" || len(check.Masks) > 0 && check.MaskPath == "" {
+		indexDir, err := indexDirForOutputDir(outputDirTemplate(""))
+		if err != nil {
+			return err
+		}
+		if check.DiffPath == "" {
+			check.DiffPath = filepath.Join(indexDir, stem+"_diff.png")
+		}
+		if check.MaskPath == "" {
+			check.MaskPath = filepath.Join(indexDir, stem+"_mask.png")
+		}
+	}
+
+	session, err := scope.open()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if recipe != nil {
+		if _, err := recipe.apply(session.Conn); err != nil {
+			return err
+		}
+	}
+	record := captureRecordT{
+		Time:       time.Now(),
+		Session:    sessionID,
+		Host:       config.Hostname,
+		Project:    config.Project,
+		Instrument: session.Instrument,
+		Scope:      config.Scope,
+		Layout:     config.Layout,
+		Labels:     config.Labels,
+	}
+	if record.Settings, err = querySettings(session.Conn); err != nil {
+		return err
+	}
+	if record.Measurements, err = queryMeasurements(session.Conn, recipe.withMeasurements(config.Measurements)); err != nil {
+		return err
+	}
+	sources := []string{}
+	for _, mask := range check.Masks {
+		sources = append(sources, mask.Source)
+	}
+	var waveforms []waveformT
+	if len(sources) > 0 {
+		if waveforms, err = readWaveforms(session.Conn, sources); err != nil {
+			return err
+		}
+	}
+	captured, _, err := captureImage(session.Conn, flagScopeFormat, session.Instrument.Model, false)
+	if err != nil {
+		return err
+	}
+
+	passed := true
+	if check.Golden != "" {
+		ok, err := check.compareWithGolden(captured, record)
+		if err != nil {
+			return err
+		}
+		passed = passed && ok
+	}
+	if len(check.Masks) > 0 {
+		ok, err := check.testMasks(captured, waveforms, record)
+		if err != nil {
+			return err
+		}
+		passed = passed && ok
+	}
+	if !passed {
+		return fmt.Errorf("the check failed")
+	}
+	return nil
+}
+
+// goldenWaveformMasks derives a mask for each waveform in a waveform CSV.
+func goldenWaveformMasks(path, tolerance, timeTolerance string) ([]maskT, error) {
+	volts, err := parseSI(tolerance, "V")
+	if err != nil {
+		return nil, fmt.Errorf("invalid -tolerance: %v", err)
+	}
+	seconds, err := parseSI(timeTolerance, "s")
+	if err != nil {
+		return nil, fmt.Errorf("invalid -time-tolerance: %v", err)
+	}
+	golden, err := readWaveformCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	masks := []maskT{}
+	for _, waveform := range golden {
+		masks = append(masks, deriveMask(waveform, volts, seconds))
+	}
+	return masks, nil
+}
+
+// compareWithGolden compares the captured graticule with the golden image's, ignoring the parts
+// of the screen which change between captures. If too much differs then a diff image is written.
+// Each image's graticule is found using the layout it was captured with.
+func (c checkT) compareWithGolden(captured image.Image, record captureRecordT) (bool, error) {
+	golden, err := readCaptureImage(c.Golden)
+	if err != nil {
+		return false, err
+	}
+	goldenRecord, _, err := readCaptureMetadata(c.Golden)
+	if err != nil {
+		log.InfoPrintf("WARNING: Unable to read metadata from %q: %v", c.Golden, err)
+	}
+	graticule := viewT{Region: "graticule", Scale: 1}
+	layout := layoutForImage(captured, record.Layout)
+	diff, changed, compared := diffImages(graticule.apply(golden, layoutForImage(golden, goldenRecord.Layout)),
+		graticule.apply(captured, layout), c.Threshold, layout.MaskRects)
+	percent := percentOf(changed, compared)
+	if percent <= c.Limit {
+		fmt.Printf("PASS: %.2f%% of the graticule differs from %q (limit %.2f%%)\n", percent, c.Golden, c.Limit)
+		return true, nil
+	}
+	fmt.Printf("FAIL: %.2f%% of the graticule differs from %q (limit %.2f%%)\n", percent, c.Golden, c.Limit)
+
+	composite := newComparison(diff.Bounds().Dx(), diff.Bounds().Dy())
+	draw.Draw(composite, diff.Bounds().Add(image.Pt(0, captionHeight)), diff, image.Point{}, draw.Src)
+	addDiffCaption(composite, fmt.Sprintf("FAIL %.2f%% differ (limit %.2f%%)", percent, c.Limit),
+		"golden", "capture")
+	data, err := encodePNG(composite, encodeOptionsT{})
+	if err != nil {
+		return false, err
+	}
+	if err := writeDerivedImage(c.DiffPath, data, kindCheck); err != nil {
+		return false, err
+	}
+	log.InfoPrintf("Wrote diff image to %q.", c.DiffPath)
+	return false, nil
+}
+
+// testMasks tests the waveforms against the masks, reports any violations, and writes an
+// annotated capture showing the masks and violations, with the waveforms alongside.
+func (c checkT) testMasks(captured image.Image, waveforms []waveformT, record captureRecordT) (bool, error) {
+	violations := []violationT{}
+	for i, mask := range c.Masks {
+		violations = append(violations, mask.test(waveforms[i])...)
+	}
+	sources := []string{}
+	for _, mask := range c.Masks {
+		sources = append(sources, mask.Source)
+	}
+	result := "PASS"
+	if len(violations) > 0 {
+		result = "FAIL"
+	}
+	fmt.Printf("%s: %d mask violation(s) (%s)\n", result, len(violations), strings.Join(sources, ", "))
+	for _, violation := range violations {
+		fmt.Printf("    %v\n", violation)
+	}
+
+	record.Note = "Mask test " + result
+	theme, err := lookupTheme("")
+	if err != nil {
+		return false, err
+	}
+	layout := layoutForImage(captured, record.Layout)
+	record.Layout = layout.Name
+	annotated := addLabelsToImage(captured, layout, record.Time, record.Note, record.Labels, theme, config.Markers)
+	if err := addMasks(annotated, layout, c.Masks, violations, record.Settings, theme); err != nil {
+		return false, err
+	}
+	path, err := writeWaveforms(c.MaskPath, waveforms)
+	if err != nil {
+		return false, err
+	}
+	record.Path = c.MaskPath
+	record.Kind = kindCheck
+	record.Waveforms = filepath.Base(path)
+	if _, err := writeAnnotatedImage(c.MaskPath, annotated, record, captureOptionsT{FileType: "png"}); err != nil {
+		return false, err
+	}
+	log.InfoPrintf("Wrote mask test image to %q.", c.MaskPath)
+	return len(violations) == 0, nil
+}
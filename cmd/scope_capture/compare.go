@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// captionHeight is the height of the caption bar above a comparison
+	captionHeight = 20
+	// comparisonGap separates the two sides of a side-by-side comparison
+	comparisonGap = 4
+	// defaultDiffThreshold is the smallest change in any color component (0-255) which counts as
+	// a changed pixel
+	defaultDiffThreshold = 48
+)
+
+var (
+	colorCompareA = color.RGBA{255, 140, 0, 255} // Orange
+	colorCompareB = color.RGBA{0, 170, 255, 255} // Blue
+	colorRemoved  = color.RGBA{255, 60, 60, 255} // Red
+	colorAdded    = color.RGBA{60, 255, 60, 255} // Green
+	colorMasked   = color.RGBA{0, 0, 64, 255}    // Dark blue
+)
+
+// compareModes produce a comparison image of two captures.
+var compareModes = map[string]func(a, b comparedT, threshold int) *image.RGBA{
+	"side":    compareSideBySide,
+	"overlay": compareOverlay,
+	"diff":    compareDiff,
+}
+
+// comparedT is one of the captures being compared.
+type comparedT struct {
+	Path   string
+	Image  image.Image
+	Record captureRecordT
+}
+
+func runCompare(args []string) error {
+	var flagMode, flagOut, flagCrop string
+	var flagThreshold int
+	fs := newSubcommandFlagSet("compare", "A B")
+	fs.StringVar(&flagMode, "mode", "side",
+		"Comparison: side (side by side), overlay (the graticules blended, A in orange and B in blue) or diff (changed pixels, red in A only and green in B only)")
+	fs.StringVar(&flagOut, "o", "",
+		"Output path (Defaults to comparison_{date}_{time}.png in the index directory)")
+	fs.StringVar(&flagCrop, "crop", "",
+		fmt.Sprintf("Region of each capture to compare: %s (Defaults to full for side, otherwise graticule)",
+			regionNames(layouts[defaultLayoutName])))
+	fs.IntVar(&flagThreshold, "threshold", defaultDiffThreshold,
+		"diff: the smallest change in a pixel's red, green or blue (0-255) which counts as changed")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected two captures to compare")
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+	flagMode = strings.ToLower(flagMode)
+	compare, ok := compareModes[flagMode]
+	if !ok {
+		return fmt.Errorf("unknown comparison mode %q (expected side, overlay or diff)", flagMode)
+	}
+	if flagCrop == "" {
+		flagCrop = "graticule"
+		if flagMode == "side" {
+			flagCrop = fullRegion
+		}
+	}
+	view := defaultView
+	view.Region = strings.ToLower(flagCrop)
+	if err := checkView(view); err != nil {
+		return err
+	}
+
+	a, err := readCompared(positional[0], view)
+	if err != nil {
+		return err
+	}
+	b, err := readCompared(positional[1], view)
+	if err != nil {
+		return err
+	}
+
+	if flagOut == "" {
+		indexDir, err := indexDirForOutputDir(outputDirTemplate(""))
+		if err != nil {
+			return err
+		}
+		flagOut = filepath.Join(indexDir, "comparison_"+time.Now().Format("2006-01-02_15-04-05")+".png")
+	}
+	fileType, err := selectFormat("", flagOut)
+	if err != nil {
+		return err
+	}
+	data, err := imageFormats[fileType].Encode(compare(a, b, flagThreshold), encodeOptionsT{JPEGQuality: defaultJPEGQuality})
+	if err != nil {
+		return err
+	}
+	if err := writeDerivedImage(flagOut, data, kindComparison); err != nil {
+		return err
+	}
+	log.InfoPrintf("Wrote %s comparison to %q.", flagMode, flagOut)
+	return nil
+}
+
+// readCompared reads a capture to compare (and its metadata, if any), cropped by view.
+func readCompared(path string, view viewT) (comparedT, error) {
+	img, err := readCaptureImage(path)
+	if err != nil {
+		return comparedT{}, err
+	}
+	record, _, err := readCaptureMetadata(path)
+	if err != nil {
+		log.InfoPrintf("WARNING: Unable to read metadata from %q: %v", path, err)
+	}
+	return comparedT{Path: path, Image: view.apply(img, layoutForImage(img, "")), Record: record}, nil
+}
+
+// caption describes the capture: its note (or file name if it has none) and time.
+func (c comparedT) caption() string {
+	caption := c.Record.Note
+	if caption == "" {
+		caption = filepath.Base(c.Path)
+	}
+	if !c.Record.Time.IsZero() {
+		caption += "  " + c.Record.Time.Format("2006-01-02 15:04:05")
+	}
+	return caption
+}
+
+// compareSideBySide places the captures next to each other, each captioned.
+func compareSideBySide(a, b comparedT, threshold int) *image.RGBA {
+	sizeA, sizeB := a.Image.Bounds().Size(), b.Image.Bounds().Size()
+	composite := newComparison(sizeA.X+comparisonGap+sizeB.X, max(sizeA.Y, sizeB.Y))
+	offsetB := sizeA.X + comparisonGap
+	draw.Draw(composite, image.Rect(0, captionHeight, sizeA.X, captionHeight+sizeA.Y),
+		a.Image, a.Image.Bounds().Min, draw.Src)
+	draw.Draw(composite, image.Rect(offsetB, captionHeight, offsetB+sizeB.X, captionHeight+sizeB.Y),
+		b.Image, b.Image.Bounds().Min, draw.Src)
+	addLabel(composite, "A: "+a.caption(), 4, 2, colorNote)
+	addLabel(composite, "B: "+b.caption(), offsetB+4, 2, colorNote)
+	return composite
+}
+
+// compareOverlay blends the captures, tinting each by its brightness, so that traces which
+// are only in A are orange, only in B are blue, and in both are white.
+func compareOverlay(a, b comparedT, threshold int) *image.RGBA {
+	size := overlapSize(a, b)
+	composite := newComparison(size.X, size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			levelA := brightness(a.Image.At(a.Image.Bounds().Min.X+x, a.Image.Bounds().Min.Y+y))
+			levelB := brightness(b.Image.At(b.Image.Bounds().Min.X+x, b.Image.Bounds().Min.Y+y))
+			composite.SetRGBA(x, captionHeight+y, color.RGBA{
+				tint(colorCompareA.R, levelA, colorCompareB.R, levelB),
+				tint(colorCompareA.G, levelA, colorCompareB.G, levelB),
+				tint(colorCompareA.B, levelA, colorCompareB.B, levelB),
+				255,
+			})
+		}
+	}
+	captionA := "A: " + a.caption()
+	addLabel(composite, captionA, 4, 2, colorCompareA)
+	addLabel(composite, "B: "+b.caption(), 4+(len(captionA)+2)*8, 2, colorCompareB)
+	return composite
+}
+
+// compareDiff shows B dimmed, with the pixels which differ from A highlighted (see diffImages).
+func compareDiff(a, b comparedT, threshold int) *image.RGBA {
+	diff, changed, compared := diffImages(a.Image, b.Image, threshold, nil)
+	composite := newComparison(diff.Bounds().Dx(), diff.Bounds().Dy())
+	draw.Draw(composite, diff.Bounds().Add(image.Pt(0, captionHeight)), diff, image.Point{}, draw.Src)
+	summary := fmt.Sprintf("%d pixels (%.2f%%) differ", changed, percentOf(changed, compared))
+	log.InfoPrintf("%s.", summary)
+	addDiffCaption(composite, summary, "A", "B")
+	return composite
+}
+
+// diffImages compares the area covered by both a and b (aligned at their top left corners). It
+// returns b, dimmed, with the pixels which differ by at least threshold highlighted: red where
+// a is brighter (e.g. a trace which has gone) and green where b is brighter (e.g. a new trace).
+// Pixels inside masks (in a's coordinates) are not compared, and are drawn dark blue.
+func diffImages(a, b image.Image, threshold int, masks []image.Rectangle) (diff *image.RGBA, changed, compared int) {
+	boundsA, boundsB := a.Bounds(), b.Bounds()
+	if boundsA.Size() != boundsB.Size() {
+		log.InfoPrintf("WARNING: The images are different sizes (%v and %v); comparing the overlap.",
+			boundsA.Size(), boundsB.Size())
+	}
+	diff = image.NewRGBA(image.Rect(0, 0, min(boundsA.Dx(), boundsB.Dx()), min(boundsA.Dy(), boundsB.Dy())))
+	for y := 0; y < diff.Bounds().Dy(); y++ {
+		for x := 0; x < diff.Bounds().Dx(); x++ {
+			pointA := boundsA.Min.Add(image.Pt(x, y))
+			if inAny(pointA, masks) {
+				diff.SetRGBA(x, y, colorMasked)
+				continue
+			}
+			compared++
+			pixelA := color.RGBAModel.Convert(a.At(pointA.X, pointA.Y)).(color.RGBA)
+			pixelB := color.RGBAModel.Convert(b.At(boundsB.Min.X+x, boundsB.Min.Y+y)).(color.RGBA)
+			levelA, levelB := brightness(pixelA), brightness(pixelB)
+			pixel := color.RGBA{levelB / 4, levelB / 4, levelB / 4, 255}
+			if pixelDifference(pixelA, pixelB) >= threshold {
+				changed++
+				pixel = colorAdded
+				if levelA > levelB {
+					pixel = colorRemoved
+				}
+			}
+			diff.SetRGBA(x, y, pixel)
+		}
+	}
+	return diff, changed, compared
+}
+
+// addDiffCaption draws a diff's caption: its summary, followed by a key to the colors using the
+// names of the two images.
+func addDiffCaption(composite *image.RGBA, summary, nameA, nameB string) {
+	keyA, keyB := nameA+" only", nameB+" only"
+	addLabel(composite, summary, 4, 2, colorNote)
+	addLabel(composite, keyA, 4+(len(summary)+2)*8, 2, colorRemoved)
+	addLabel(composite, keyB, 4+(len(summary)+len(keyA)+4)*8, 2, colorAdded)
+}
+
+// percentOf returns n as a percentage of total.
+func percentOf(n, total int) float64 {
+	return 100 * float64(n) / float64(max(total, 1))
+}
+
+// inAny returns whether p is inside any of rects.
+func inAny(p image.Point, rects []image.Rectangle) bool {
+	for _, rect := range rects {
+		if p.In(rect) {
+			return true
+		}
+	}
+	return false
+}
+
+// newComparison returns a black comparison image, with room for the caption bar above an area
+// of the given size.
+func newComparison(width, height int) *image.RGBA {
+	composite := image.NewRGBA(image.Rect(0, 0, width, captionHeight+height))
+	draw.Draw(composite, composite.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	return composite
+}
+
+// overlapSize returns the size of the area covered by both captures (when aligned at their top
+// left corners).
+func overlapSize(a, b comparedT) image.Point {
+	sizeA, sizeB := a.Image.Bounds().Size(), b.Image.Bounds().Size()
+	if sizeA != sizeB {
+		log.InfoPrintf("WARNING: The captures are different sizes (%v and %v); comparing the overlap.", sizeA, sizeB)
+	}
+	return image.Pt(min(sizeA.X, sizeB.X), min(sizeA.Y, sizeB.Y))
+}
+
+// brightness returns the largest of a color's red, green and blue components, so that
+// saturated trace colors count as bright.
+func brightness(c color.Color) uint8 {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	return max(rgba.R, rgba.G, rgba.B)
+}
+
+// tint returns a color component of the sum of two tints, each scaled by a brightness.
+func tint(componentA, levelA, componentB, levelB uint8) uint8 {
+	return uint8(min((int(componentA)*int(levelA)+int(componentB)*int(levelB))/255, 255))
+}
+
+// pixelDifference returns the largest difference between the red, green or blue components of
+// two colors.
+func pixelDifference(a, b color.RGBA) int {
+	return max(abs(int(a.R)-int(b.R)), abs(int(a.G)-int(b.G)), abs(int(a.B)-int(b.B)))
+}
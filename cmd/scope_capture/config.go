@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"image/color"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 var config = configT{
@@ -22,12 +25,56 @@ type configT struct {
 	ScopePort     int
 	ScopeHostname string
 	Hostname      string
+	// FilenameTemplate (optional) names output files when -file is not given
+	FilenameTemplate string
+	// OutputDir (optional) is the output directory, which may be a template
+	OutputDir string
+	// Project (optional) is the value of the {project} template token
+	Project string
+	// KeepRaw keeps every raw capture alongside its annotated version
+	KeepRaw bool
+	// EmbedSetup embeds the scope's setup in each capture's metadata
+	EmbedSetup bool
+	// Theme (optional) is the color theme name
+	Theme string
+	// Palette (optional) is the annotation palette name
+	Palette string
+	// Colors (optional) override the palette for particular sources or source kinds
+	Colors map[string]color.Color
+	// Markers draws a line style sample next to each label
+	Markers bool
+	// Measurements (optional) are recorded with each capture, e.g. "VPP CH1"
+	Measurements []string
+	// ScopeFormats (optional) maps model names (or prefixes) to the image format to request
+	ScopeFormats map[string]string
+	// Scopes (optional) are scope profiles, selected with -scope (or captured from together with
+	// -scopes), and DefaultScope (optional) is the profile used when -scope isn't given
+	Scopes       map[string]scopeT
+	DefaultScope string
+	// Scope is the name of the selected scope profile (if any), and Layout and Labels are its
+	// layout and default labels
+	Scope  string
+	Layout string
+	Labels []labelT
 }
 
 // fileConfig is used only for unmarshaling JSON
 type fileConfig struct {
-	Hostname string `json:"hostname"`
-	Port     int    `json:"port"`
+	Hostname         string            `json:"hostname"`
+	Port             int               `json:"port"`
+	FilenameTemplate string            `json:"filename_template"`
+	OutputDir        string            `json:"output_dir"`
+	Project          string            `json:"project"`
+	KeepRaw          bool              `json:"keep_raw"`
+	EmbedSetup       bool              `json:"embed_setup"`
+	Theme            string            `json:"theme"`
+	Palette          string            `json:"palette"`
+	Colors           map[string]string `json:"colors"`
+	Markers          bool              `json:"markers"`
+	Measurements     []string          `json:"measurements"`
+	ScopeFormats     map[string]string `json:"scope_formats"`
+	Scopes           map[string]scopeT `json:"scopes"`
+	DefaultScope     string            `json:"default_scope"`
 }
 
 // loadAndParseConfigFile tries to load configuration from either
@@ -75,6 +122,88 @@ func loadAndParseConfigFile() error {
 				log.InfoPrintf("        Adopting scope port from config file: %d", fc.Port)
 				itemsFound = true
 			}
+			if fc.FilenameTemplate != "" {
+				config.FilenameTemplate = fc.FilenameTemplate
+				log.InfoPrintf("        Adopting filename template from config file: %q", fc.FilenameTemplate)
+				itemsFound = true
+			}
+			if fc.OutputDir != "" {
+				config.OutputDir = fc.OutputDir
+				log.InfoPrintf("        Adopting output directory from config file: %q", fc.OutputDir)
+				itemsFound = true
+			}
+			if fc.Project != "" {
+				config.Project = fc.Project
+				log.InfoPrintf("        Adopting project from config file: %q", fc.Project)
+				itemsFound = true
+			}
+			if fc.KeepRaw {
+				config.KeepRaw = fc.KeepRaw
+				log.InfoPrint("        Adopting keep_raw from config file: true")
+				itemsFound = true
+			}
+			if fc.EmbedSetup {
+				config.EmbedSetup = fc.EmbedSetup
+				log.InfoPrint("        Adopting embed_setup from config file: true")
+				itemsFound = true
+			}
+			if fc.Theme != "" {
+				config.Theme = fc.Theme
+				log.InfoPrintf("        Adopting theme from config file: %q", fc.Theme)
+				itemsFound = true
+			}
+			if fc.Palette != "" {
+				config.Palette = fc.Palette
+				log.InfoPrintf("        Adopting palette from config file: %q", fc.Palette)
+				itemsFound = true
+			}
+			if len(fc.Colors) > 0 {
+				config.Colors, err = parseColors(fc.Colors)
+				if err != nil {
+					return fmt.Errorf("invalid colors in config file: %v", err)
+				}
+				log.InfoPrintf("        Adopting colors from config file: %v", fc.Colors)
+				itemsFound = true
+			}
+			if fc.Markers {
+				config.Markers = fc.Markers
+				log.InfoPrint("        Adopting markers from config file: true")
+				itemsFound = true
+			}
+			if len(fc.Measurements) > 0 {
+				config.Measurements, err = parseMeasurements(strings.Join(fc.Measurements, ","))
+				if err != nil {
+					return fmt.Errorf("invalid measurements in config file: %v", err)
+				}
+				log.InfoPrintf("        Adopting measurements from config file: %s", strings.Join(config.Measurements, ", "))
+				itemsFound = true
+			}
+			if len(fc.ScopeFormats) > 0 {
+				config.ScopeFormats = fc.ScopeFormats
+				log.InfoPrintf("        Adopting scope formats from config file: %v", fc.ScopeFormats)
+				itemsFound = true
+			}
+			if len(fc.Scopes) > 0 {
+				names := []string{}
+				for name, scope := range fc.Scopes {
+					if err := scope.check(); err != nil {
+						return fmt.Errorf("invalid scope %q in config file: %v", name, err)
+					}
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				config.Scopes = fc.Scopes
+				log.InfoPrintf("        Adopting scopes from config file: %s", strings.Join(names, ", "))
+				itemsFound = true
+			}
+			if fc.DefaultScope != "" {
+				if _, ok := fc.Scopes[fc.DefaultScope]; !ok {
+					return fmt.Errorf("default_scope %q in config file is not one of its scopes", fc.DefaultScope)
+				}
+				config.DefaultScope = fc.DefaultScope
+				log.InfoPrintf("        Adopting default scope from config file: %q", fc.DefaultScope)
+				itemsFound = true
+			}
 			if !itemsFound {
 				log.InfoPrint("        WARNING: No (known) configuration items found in config file.")
 			}
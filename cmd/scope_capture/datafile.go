@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readDataFile reads a recipe, procedure or drawings file, returning its contents as JSON.
+// Files with a .yaml or .yml extension are YAML, and are converted; any other file is JSON, and
+// is returned as is.
+func readDataFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" {
+		return data, nil
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", path, err)
+	}
+	value, err := yamlValue(&document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", path, err)
+	}
+	return json.Marshal(value)
+}
+
+// yamlValue converts a YAML node to a value which encodes as the equivalent JSON. Every scalar
+// except booleans and nulls becomes a string, since the files' values are strings even when
+// they look like numbers (e.g. a setting of 10 or a limit of 1.8).
+func yamlValue(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case 0:
+		// An empty document
+		return nil, nil
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(node.Alias)
+	case yaml.SequenceNode:
+		values := []any{}
+		for _, item := range node.Content {
+			value, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case yaml.MappingNode:
+		values := map[string]any{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: keys must be strings", key.Line)
+			}
+			value, err := yamlValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			values[key.Value] = value
+		}
+		return values, nil
+	}
+	switch node.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var value bool
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	return node.Value, nil
+}
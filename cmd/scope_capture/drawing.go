@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+var colorDrawing = color.RGBA{255, 64, 64, 255} // Red
+
+// drawingT is a freeform annotation: an arrow, rectangle, circle or text callout.
+//
+// Points are "X,Y" pairs. Each coordinate is in pixels (e.g. "300"), in graticule divisions from
+// the screen center (e.g. "2.5div", with positive Y up), or in scope units: a time for X (e.g.
+// "1.2ms", relative to the trigger) or a voltage for Y (e.g. "2.5V", or "2.5V@CH2" for a channel
+// other than the trigger source).
+type drawingT struct {
+	// Kind is "arrow", "rect", "circle" or "text"
+	Kind string `json:"kind"`
+	// Points are the arrow's tail and head, the rectangle's corners, the circle's center or
+	// the text's top left corner
+	Points []string `json:"points"`
+	// Radius is the circle's radius, in pixels or divisions (e.g. "20" or "0.5div")
+	Radius string `json:"radius,omitempty"`
+	// Text is drawn at the arrow's tail, above the rectangle or circle, or at the text's point
+	Text string `json:"text,omitempty"`
+	// Color is "#rrggbb" (Defaults to red)
+	Color string `json:"color,omitempty"`
+}
+
+// drawingPoints is the number of points each kind of drawing takes.
+var drawingPoints = map[string]int{"arrow": 2, "rect": 2, "circle": 1, "text": 1}
+
+// check returns an error if the drawing is malformed. Coordinates in scope units can only be
+// checked against a capture's settings, when it is drawn.
+func (d drawingT) check() error {
+	n, ok := drawingPoints[d.Kind]
+	if !ok {
+		return fmt.Errorf("unknown drawing kind %q (expected arrow, rect, circle or text)", d.Kind)
+	}
+	if len(d.Points) != n {
+		return fmt.Errorf("%s needs %d point(s), got %d", d.Kind, n, len(d.Points))
+	}
+	if d.Kind == "circle" && d.Radius == "" {
+		return fmt.Errorf("circle needs a radius")
+	}
+	if d.Kind == "text" && d.Text == "" {
+		return fmt.Errorf("text needs some text")
+	}
+	if d.Color != "" {
+		if _, err := parseHexColor(d.Color); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drawingsFlag collects repeated `-draw "KIND POINT [POINT] [TEXT]"` command line arguments,
+// e.g. -draw "arrow 1.2ms,2.5V 300,100 Glitch" or -draw "circle 400,200 15 Here".
+type drawingsFlag []drawingT
+
+func (d *drawingsFlag) String() string {
+	items := []string{}
+	for _, drawing := range *d {
+		items = append(items, drawing.Kind+" "+strings.Join(drawing.Points, " "))
+	}
+	return strings.Join(items, "; ")
+}
+
+func (d *drawingsFlag) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty drawing")
+	}
+	drawing := drawingT{Kind: strings.ToLower(fields[0])}
+	n, ok := drawingPoints[drawing.Kind]
+	if !ok {
+		return fmt.Errorf("unknown drawing kind %q (expected arrow, rect, circle or text)", fields[0])
+	}
+	fields = fields[1:]
+	if len(fields) < n {
+		return fmt.Errorf("%s needs %d point(s)", drawing.Kind, n)
+	}
+	drawing.Points, fields = fields[:n], fields[n:]
+	if drawing.Kind == "circle" && len(fields) > 0 {
+		drawing.Radius, fields = fields[0], fields[1:]
+	}
+	drawing.Text = strings.Join(fields, " ")
+	if err := drawing.check(); err != nil {
+		return err
+	}
+	*d = append(*d, drawing)
+	return nil
+}
+
+// loadDrawings reads drawings from a file holding {"drawings": [...]}, as JSON (or YAML if it has
+// a .yaml or .yml extension).
+func loadDrawings(path string) ([]drawingT, error) {
+	data, err := readDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Drawings []drawingT `json:"drawings"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %v", path, err)
+	}
+	for i, drawing := range file.Drawings {
+		drawing.Kind = strings.ToLower(drawing.Kind)
+		if err := drawing.check(); err != nil {
+			return nil, fmt.Errorf("%q drawing %d: %v", path, i+1, err)
+		}
+		file.Drawings[i] = drawing
+	}
+	return file.Drawings, nil
+}
+
+// graticuleT maps graticule and scope coordinates to pixels.
+type graticuleT struct {
+	Center       struct{ X, Y float64 }
+	PixelsPerDiv float64
+	Settings     map[string]string
+}
+
+func newGraticule(layout *layoutT, settings map[string]string) graticuleT {
+	rect := layout.Regions["graticule"]
+	g := graticuleT{Settings: settings}
+	// The graticule rectangle includes both outer grid lines
+	g.PixelsPerDiv = float64(rect.Dx()-1) / float64(layout.Divisions.X)
+	g.Center.X = float64(rect.Min.X) + float64(rect.Dx()-1)/2
+	g.Center.Y = float64(rect.Min.Y) + float64(rect.Dy()-1)/2
+	return g
+}
+
+// setting returns a numeric scope setting.
+func (g graticuleT) setting(key string) (float64, error) {
+	value, ok := g.Settings[key]
+	if !ok {
+		return 0, fmt.Errorf("the capture has no %s setting", key)
+	}
+	return parseSI(value, "")
+}
+
+// point converts an "X,Y" point to pixels.
+func (g graticuleT) point(spec string) (image.Point, error) {
+	xSpec, ySpec, found := strings.Cut(spec, ",")
+	if !found {
+		return image.Point{}, fmt.Errorf("point %q is not of the form X,Y", spec)
+	}
+	x, err := g.coordinate(strings.TrimSpace(xSpec), true)
+	if err != nil {
+		return image.Point{}, err
+	}
+	y, err := g.coordinate(strings.TrimSpace(ySpec), false)
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(int(math.Round(x)), int(math.Round(y))), nil
+}
+
+// coordinate converts a single X (isX) or Y coordinate to pixels.
+func (g graticuleT) coordinate(spec string, isX bool) (float64, error) {
+	switch {
+	case strings.HasSuffix(spec, "div"):
+		divs, err := parseSI(strings.TrimSuffix(spec, "div"), "")
+		if err != nil {
+			return 0, err
+		}
+		if isX {
+			return g.Center.X + divs*g.PixelsPerDiv, nil
+		}
+		return g.Center.Y - divs*g.PixelsPerDiv, nil
+
+	case isX && strings.HasSuffix(spec, "s"):
+		t, err := parseSI(spec, "s")
+		if err != nil {
+			return 0, err
+		}
+		return g.timeX(t)
+
+	case !isX && (strings.HasSuffix(spec, "V") || strings.Contains(spec, "@")):
+		voltage, channel, hasChannel := strings.Cut(spec, "@")
+		source := g.Settings["trigger_source"]
+		if hasChannel {
+			source = channel
+		}
+		source, err := canonicalSource(source)
+		if err != nil || !strings.HasPrefix(source, "CH") {
+			// e.g. the trigger source is AC line or external
+			source = "CH1"
+		}
+		v, err := parseSI(voltage, "V")
+		if err != nil {
+			return 0, err
+		}
+		return g.voltsY(v, source)
+	}
+	pixels, err := parseSI(spec, "")
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate %q", spec)
+	}
+	return pixels, nil
+}
+
+// timeX returns the X pixel coordinate of a time relative to the trigger.
+func (g graticuleT) timeX(t float64) (float64, error) {
+	scale, err := g.setting("timebase")
+	if err != nil {
+		return 0, err
+	}
+	offset, err := g.setting("timebase_offset")
+	if err != nil {
+		return 0, err
+	}
+	return g.Center.X + (t-offset)/scale*g.PixelsPerDiv, nil
+}
+
+// voltsY returns the Y pixel coordinate of a voltage on a canonical analog source (e.g. "CH1").
+func (g graticuleT) voltsY(v float64, source string) (float64, error) {
+	n := strings.TrimPrefix(source, "CH")
+	scale, err := g.setting("ch" + n + "_scale")
+	if err != nil {
+		return 0, fmt.Errorf("%s is not displayed: %v", source, err)
+	}
+	offset, err := g.setting("ch" + n + "_offset")
+	if err != nil {
+		return 0, err
+	}
+	return g.Center.Y - (v+offset)/scale*g.PixelsPerDiv, nil
+}
+
+// addDrawings draws the drawings on img, using its layout and the capture's settings to place
+// scope coordinates.
+func addDrawings(img *image.RGBA, layout *layoutT, drawings []drawingT, settings map[string]string, theme *themeT) error {
+	g := newGraticule(layout, settings)
+	for i, drawing := range drawings {
+		if err := drawing.draw(img, g, theme); err != nil {
+			return fmt.Errorf("drawing %d (%s): %v", i+1, drawing.Kind, err)
+		}
+	}
+	return nil
+}
+
+func (d drawingT) draw(img *image.RGBA, g graticuleT, theme *themeT) error {
+	col := color.Color(colorDrawing)
+	if d.Color != "" {
+		col, _ = parseHexColor(d.Color)
+	}
+	col = theme.Annotation(col)
+	points := []image.Point{}
+	for _, spec := range d.Points {
+		p, err := g.point(spec)
+		if err != nil {
+			return err
+		}
+		points = append(points, p)
+	}
+
+	switch d.Kind {
+	case "arrow":
+		tail, head := points[0], points[1]
+		drawLine(img, tail, head, col)
+		angle := math.Atan2(float64(tail.Y-head.Y), float64(tail.X-head.X))
+		const headLength, headAngle = 10.0, math.Pi / 7
+		for _, side := range []float64{-1, 1} {
+			a := angle + side*headAngle
+			barb := image.Pt(head.X+int(math.Round(headLength*math.Cos(a))), head.Y+int(math.Round(headLength*math.Sin(a))))
+			drawLine(img, head, barb, col)
+		}
+		if d.Text != "" {
+			// Put the text beyond the tail, so that it doesn't cover the arrow
+			width := len([]rune(d.Text)) * 8
+			x := tail.X + 4
+			if head.X > tail.X {
+				x = tail.X - 4 - width
+			}
+			addCallout(img, d.Text, image.Pt(x, tail.Y-7), col, theme)
+		}
+
+	case "rect":
+		r := image.Rectangle{points[0], points[1]}.Canon()
+		drawLine(img, r.Min, image.Pt(r.Max.X, r.Min.Y), col)
+		drawLine(img, image.Pt(r.Max.X, r.Min.Y), r.Max, col)
+		drawLine(img, r.Max, image.Pt(r.Min.X, r.Max.Y), col)
+		drawLine(img, image.Pt(r.Min.X, r.Max.Y), r.Min, col)
+		if d.Text != "" {
+			addCallout(img, d.Text, image.Pt(r.Min.X, r.Min.Y-18), col, theme)
+		}
+
+	case "circle":
+		radius, err := g.length(d.Radius)
+		if err != nil {
+			return err
+		}
+		center := points[0]
+		steps := max(16, int(2*math.Pi*radius))
+		previous := image.Pt(center.X+int(math.Round(radius)), center.Y)
+		for i := 1; i <= steps; i++ {
+			a := 2 * math.Pi * float64(i) / float64(steps)
+			p := image.Pt(center.X+int(math.Round(radius*math.Cos(a))), center.Y+int(math.Round(radius*math.Sin(a))))
+			drawLine(img, previous, p, col)
+			previous = p
+		}
+		if d.Text != "" {
+			addCallout(img, d.Text, image.Pt(center.X-int(radius), center.Y-int(radius)-18), col, theme)
+		}
+
+	case "text":
+		addCallout(img, d.Text, points[0], col, theme)
+	}
+	return nil
+}
+
+// length converts a length in pixels or divisions (e.g. "0.5div") to pixels.
+func (g graticuleT) length(spec string) (float64, error) {
+	if strings.HasSuffix(spec, "div") {
+		divs, err := parseSI(strings.TrimSuffix(spec, "div"), "")
+		return divs * g.PixelsPerDiv, err
+	}
+	return parseSI(spec, "")
+}
+
+// drawLine draws a two pixel wide line from a to b.
+func drawLine(img *image.RGBA, a, b image.Point, col color.Color) {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	steps := max(abs(dx), abs(dy), 1)
+	for i := 0; i <= steps; i++ {
+		x := a.X + int(math.Round(float64(dx*i)/float64(steps)))
+		y := a.Y + int(math.Round(float64(dy*i)/float64(steps)))
+		draw.Draw(img, image.Rect(x, y, x+2, y+2), &image.Uniform{col}, image.Point{}, draw.Src)
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// addCallout draws text with its top left corner at p, on a background box so that it is
+// legible over traces and the grid.
+func addCallout(img *image.RGBA, text string, p image.Point, col color.Color, theme *themeT) {
+	box := image.Rect(p.X-2, p.Y, p.X+len([]rune(text))*8+2, p.Y+16)
+	draw.Draw(img, box, &image.Uniform{theme.Background}, image.Point{}, draw.Src)
+	addLabel(img, text, p.X, p.Y, col)
+}
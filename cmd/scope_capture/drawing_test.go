@@ -0,0 +1,96 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func testGraticule() graticuleT {
+	// The ds1000z graticule is 12x8 divisions of 50 pixels, centered on (384, 238)
+	return newGraticule(layouts["ds1000z"], map[string]string{
+		"timebase":        "5.000000e-04",
+		"timebase_offset": "1.000000e-03",
+		"ch1_scale":       "1.000000e+00",
+		"ch1_offset":      "-2.000000e+00",
+		"ch2_scale":       "5.000000e-01",
+		"ch2_offset":      "0.000000e+00",
+		"trigger_source":  "CHAN2",
+	})
+}
+
+func TestTimeX(t *testing.T) {
+	g := testGraticule()
+	tests := []struct {
+		t    float64
+		want float64
+	}{
+		{1e-3, 384},    // The offset is at the center
+		{1.5e-3, 434},  // One division later
+		{0, 284},       // The trigger is two divisions left of center
+		{-2e-3, 84},    // The left hand grid line
+		{4e-3, 684},    // The right hand grid line
+		{0.25e-3, 309}, // Half a division
+	}
+	for _, test := range tests {
+		got, err := g.timeX(test.t)
+		if err != nil || got != test.want {
+			t.Errorf("timeX(%v) = %v, %v; want %v", test.t, got, err, test.want)
+		}
+	}
+
+	delete(g.Settings, "timebase_offset")
+	if _, err := g.timeX(0); err == nil {
+		t.Errorf("timeX() without an offset setting succeeded")
+	}
+}
+
+func TestVoltsY(t *testing.T) {
+	g := testGraticule()
+	tests := []struct {
+		v      float64
+		source string
+		want   float64
+		ok     bool
+	}{
+		{2, "CH1", 238, true},  // The offset is at the center
+		{3, "CH1", 188, true},  // Y increases downwards
+		{0, "CH1", 338, true},  // 0V is two divisions below center
+		{0, "CH2", 238, true},  // No offset
+		{1, "CH2", 138, true},  // 0.5V per division
+		{-2, "CH2", 438, true}, // The bottom grid line
+		{0, "CH3", 0, false},   // Not displayed
+	}
+	for _, test := range tests {
+		got, err := g.voltsY(test.v, test.source)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("voltsY(%v, %s) = %v, %v; want %v (ok %v)", test.v, test.source, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestGraticulePoint(t *testing.T) {
+	g := testGraticule()
+	tests := []struct {
+		spec string
+		want image.Point
+		ok   bool
+	}{
+		{"0div,0div", image.Pt(384, 238), true},
+		{"-6div, 4div", image.Pt(84, 38), true},
+		{"1.5ms,2V@CH1", image.Pt(434, 238), true},
+		// A voltage without a channel is on the trigger source
+		{"0s,1V", image.Pt(284, 138), true},
+		{"0s,3V@CH1", image.Pt(284, 188), true},
+		{"0s,1@ch2", image.Pt(284, 138), true},
+		{"100,200", image.Pt(100, 200), true},
+		{"100", image.Point{}, false},
+		{"1ms,2A", image.Point{}, false},
+		{"0s,1V@CH3", image.Point{}, false},
+	}
+	for _, test := range tests {
+		got, err := g.point(test.spec)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("point(%q) = %v, %v; want %v (ok %v)", test.spec, got, err, test.want, test.ok)
+		}
+	}
+}
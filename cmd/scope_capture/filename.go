@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// seqToken is left in place by expandTemplate and is replaced with a sequence number when
+	// the output file is allocated.
+	seqToken  = "{seq}"
+	seqFormat = "%03d"
+
+	defaultNoteFilenameTemplate = "{note}.{ext}"
+	defaultFilenameTemplate     = "{manufacturer}_{model}_{serial}_{firmware}_{date}_{time}.{ext}"
+)
+
+// instrumentT holds the fields of the *IDN? response.
+type instrumentT struct {
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	Serial       string `json:"serial"`
+	Firmware     string `json:"firmware"`
+}
+
+// parseInstrumentID splits an *IDN? response such as
+// "RIGOL TECHNOLOGIES,DS1054Z,DS1ZA221102281,00.04.04.SP4" into its fields.
+func parseInstrumentID(idn string) instrumentT {
+	fields := strings.Split(idn, ",")
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	return instrumentT{
+		Manufacturer: strings.TrimSpace(fields[0]),
+		Model:        strings.TrimSpace(fields[1]),
+		Serial:       strings.TrimSpace(fields[2]),
+		Firmware:     strings.TrimSpace(fields[3]),
+	}
+}
+
+// templateContextT holds everything a filename or output directory template can refer to.
+type templateContextT struct {
+	Time       time.Time
+	Instrument instrumentT
+	Note       string
+	Project    string
+	Labels     []labelT
+	Ext        string
+	// Scope is the name of the scope, when capturing from several
+	Scope string
+	// Query is used to read scope settings referenced by the template (e.g. {timebase}). It
+	// may be nil if no scope is available.
+	Query func(scpi string) (string, error)
+}
+
+// templateTokens documents the tokens understood by expandTemplate.
+var templateTokens = []string{
+	"{date}", "{time}", "{manufacturer}", "{model}", "{serial}", "{firmware}", "{host}",
+	"{note}", "{project}", "{ext}", "{timebase}", "{label:SOURCE}", scopeToken, seqToken,
+	"{yyyy-mm-dd}", "{yyyy}", "{mm}", "{dd}",
+}
+
+// filenameTemplate returns the template used to name the output file. An explicit -file
+// (which may itself be a template) wins, then the config file template, then a default based on
+// whether a note was given.
+func filenameTemplate(filename, note string) string {
+	switch {
+	case filename != "":
+		return filename
+	case config.FilenameTemplate != "":
+		return config.FilenameTemplate
+	case note != "":
+		return defaultNoteFilenameTemplate
+	}
+	return defaultFilenameTemplate
+}
+
+// expandTemplate replaces each {token} in template with its value. Values are made filename
+// safe individually, so separators in the template itself are preserved. If a token expands to
+// nothing then an adjacent separator is dropped so that e.g. "{date}_{note}.png" with no note
+// gives "2025-01-16.png" rather than "2025-01-16_.png". The {seq} token is left in place.
+func expandTemplate(template string, ctx templateContextT) (string, error) {
+	var out strings.Builder
+	skipSeparator := false
+	for len(template) > 0 {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			out.WriteString(template)
+			break
+		}
+		literal := template[:start]
+		if skipSeparator && len(literal) > 0 && isSeparator(literal[0]) {
+			literal = literal[1:]
+		}
+		skipSeparator = false
+		out.WriteString(literal)
+
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated token in template %q", template)
+		}
+		token := template[start : start+end+1]
+		template = template[start+end+1:]
+		if token == seqToken {
+			out.WriteString(token)
+			continue
+		}
+
+		value, err := templateTokenValue(token, ctx)
+		if err != nil {
+			return "", err
+		}
+		value = makeFilenameSafe(value)
+		if value == "" {
+			s := out.String()
+			if len(s) > 0 && isSeparator(s[len(s)-1]) {
+				out.Reset()
+				out.WriteString(s[:len(s)-1])
+			} else if len(s) == 0 {
+				skipSeparator = true
+			}
+		}
+		out.WriteString(value)
+	}
+	return out.String(), nil
+}
+
+func isSeparator(c byte) bool {
+	return c == '_' || c == '-' || c == ' '
+}
+
+// templateTokenValue returns the (unsanitized) value of a single {token}.
+func templateTokenValue(token string, ctx templateContextT) (string, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(token, "{"), "}")
+	if source, found := strings.CutPrefix(name, "label:"); found {
+		source, err := canonicalSource(source)
+		if err != nil {
+			return "", fmt.Errorf("bad template token %q: %v", token, err)
+		}
+		for _, label := range ctx.Labels {
+			if label.Source == source {
+				return label.Text, nil
+			}
+		}
+		return "", nil
+	}
+	switch name {
+	case "date":
+		return ctx.Time.Format("2006-01-02"), nil
+	case "time":
+		return ctx.Time.Format("15-04-05"), nil
+	case "yyyy-mm-dd":
+		return ctx.Time.Format("2006-01-02"), nil
+	case "yyyy":
+		return ctx.Time.Format("2006"), nil
+	case "mm":
+		return ctx.Time.Format("01"), nil
+	case "dd":
+		return ctx.Time.Format("02"), nil
+	case "manufacturer":
+		return ctx.Instrument.Manufacturer, nil
+	case "model":
+		return ctx.Instrument.Model, nil
+	case "serial":
+		return ctx.Instrument.Serial, nil
+	case "firmware":
+		return ctx.Instrument.Firmware, nil
+	case "host":
+		return config.Hostname, nil
+	case "note":
+		return ctx.Note, nil
+	case "project":
+		return ctx.Project, nil
+	case "ext":
+		return ctx.Ext, nil
+	case "scope":
+		return ctx.Scope, nil
+	case "timebase":
+		return querySI(ctx, ":TIM:MAIN:SCAL?", "s")
+	}
+	return "", fmt.Errorf("unknown template token %q (known tokens: %s)",
+		token, strings.Join(templateTokens, " "))
+}
+
+// querySI queries a numeric scope setting and formats it with an SI prefix.
+func querySI(ctx templateContextT, scpi, unit string) (string, error) {
+	if ctx.Query == nil {
+		return "", nil
+	}
+	response, err := ctx.Query(scpi)
+	if err != nil {
+		return "", err
+	}
+	value, err := strconv.ParseFloat(response, 64)
+	if err != nil {
+		return "", fmt.Errorf("unexpected response %q to %s", response, scpi)
+	}
+	return formatSI(value, unit), nil
+}
+
+// formatSI formats a value with an SI prefix, e.g. formatSI(5e-4, "s") returns "500us".
+func formatSI(value float64, unit string) string {
+	prefixes := []struct {
+		scale  float64
+		prefix string
+	}{
+		{1e9, "G"}, {1e6, "M"}, {1e3, "k"}, {1, ""}, {1e-3, "m"}, {1e-6, "u"}, {1e-9, "n"}, {1e-12, "p"},
+	}
+	if value == 0 {
+		return "0" + unit
+	}
+	for _, p := range prefixes {
+		if math.Abs(value) >= p.scale*0.9999999 {
+			return strconv.FormatFloat(value/p.scale, 'g', 6, 64) + p.prefix + unit
+		}
+	}
+	last := prefixes[len(prefixes)-1]
+	return strconv.FormatFloat(value/last.scale, 'g', 4, 64) + last.prefix + unit
+}
+
+// parseSI parses a value with an optional SI prefix and the given unit, e.g.
+// parseSI("1.5ms", "s") returns 1.5e-3. The unit itself is optional.
+func parseSI(text, unit string) (float64, error) {
+	s := strings.TrimSuffix(strings.TrimSpace(text), unit)
+	scale := 1.0
+	multipliers := map[string]float64{
+		"G": 1e9, "M": 1e6, "k": 1e3, "m": 1e-3, "u": 1e-6, "µ": 1e-6, "n": 1e-9, "p": 1e-12,
+	}
+	for prefix, multiplier := range multipliers {
+		if strings.HasSuffix(s, prefix) {
+			s, scale = strings.TrimSuffix(s, prefix), multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", text)
+	}
+	return value * scale, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	ctx := templateContextT{
+		Time:       time.Date(2025, 1, 16, 19, 24, 33, 0, time.Local),
+		Instrument: parseInstrumentID("RIGOL TECHNOLOGIES,DS1054Z,DS1ZA221102281,00.04.04.SP4"),
+		Note:       "Startup ramp",
+		Project:    "Board rev B",
+		Labels:     []labelT{{Source: "CH1", Text: "Vin"}, {Source: "D0-D7", Text: "Data bus"}},
+		Ext:        "png",
+	}
+	noNote := ctx
+	noNote.Note = ""
+	unsafe := ctx
+	unsafe.Note = `a/b: "c"`
+	withQuery := ctx
+	withQuery.Query = func(scpi string) (string, error) {
+		if scpi != ":TIM:MAIN:SCAL?" {
+			return "", fmt.Errorf("unexpected query %q", scpi)
+		}
+		return "5.000000e-04", nil
+	}
+
+	tests := []struct {
+		template string
+		ctx      templateContextT
+		want     string
+		ok       bool
+	}{
+		{"{date}_{time}.{ext}", ctx, "2025-01-16_19-24-33.png", true},
+		{"{manufacturer}_{model}_{serial}_{firmware}", ctx, "RIGOL_TECHNOLOGIES_DS1054Z_DS1ZA221102281_00.04.04.SP4", true},
+		{"{yyyy}/{mm}/{dd}/{yyyy-mm-dd}", ctx, "2025/01/16/2025-01-16", true},
+		{"{project}/{note}.{ext}", ctx, "Board_rev_B/Startup_ramp.png", true},
+		{"{note}.{ext}", unsafe, "a-b-_-c-.png", true},
+		{"{label:ch1}_{label:d0-d7}.{ext}", ctx, "Vin_Data_bus.png", true},
+		{"{note}_{seq}.{ext}", ctx, "Startup_ramp_{seq}.png", true},
+		{"literal.png", ctx, "literal.png", true},
+		// A separator next to an empty token is dropped
+		{"{date}_{note}.{ext}", noNote, "2025-01-16.png", true},
+		{"{note}_{date}.{ext}", noNote, "2025-01-16.png", true},
+		{"{date}-{label:CH2}-{time}", ctx, "2025-01-16-19-24-33", true},
+		{"{note} {seq}", noNote, "{seq}", true},
+		// Scope settings are only read if the template needs them
+		{"{timebase}_{note}", withQuery, "500us_Startup_ramp", true},
+		{"{timebase}_{note}", ctx, "Startup_ramp", true},
+		{"{unknown}.png", ctx, "", false},
+		{"{note.png", ctx, "", false},
+		{"{label:CH9}.png", ctx, "", false},
+	}
+	for _, test := range tests {
+		got, err := expandTemplate(test.template, test.ctx)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("expandTemplate(%q) = %q, %v; want %q (ok %v)", test.template, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestFormatSI(t *testing.T) {
+	tests := []struct {
+		value float64
+		unit  string
+		want  string
+	}{
+		{0, "V", "0V"},
+		{1, "V", "1V"},
+		{2.96, "V", "2.96V"},
+		{-0.08, "V", "-80mV"},
+		{5e-4, "s", "500us"},
+		{1e-9, "s", "1ns"},
+		{1e-13, "s", "0.1ps"},
+		{1000, "Hz", "1kHz"},
+		{1.5e9, "Sa/s", "1.5GSa/s"},
+		{2e10, "Sa/s", "20GSa/s"},
+		// Rounding errors don't drop to the next prefix
+		{0.9999999999e-3, "s", "1ms"},
+		{1.23456789e6, "Hz", "1.23457MHz"},
+	}
+	for _, test := range tests {
+		if got := formatSI(test.value, test.unit); got != test.want {
+			t.Errorf("formatSI(%g, %q) = %q, want %q", test.value, test.unit, got, test.want)
+		}
+	}
+}
+
+func TestParseSI(t *testing.T) {
+	tests := []struct {
+		text string
+		unit string
+		want float64
+		ok   bool
+	}{
+		{"2.5", "V", 2.5, true},
+		{"1.8V", "V", 1.8, true},
+		{" 3V ", "V", 3, true},
+		{"-80mV", "V", -0.08, true},
+		{"1.5ms", "s", 1.5e-3, true},
+		{"5us", "s", 5e-6, true},
+		{"5µs", "s", 5e-6, true},
+		{"10ns", "s", 10e-9, true},
+		{"2p", "s", 2e-12, true},
+		{"10kHz", "Hz", 1e4, true},
+		{"1MHz", "Hz", 1e6, true},
+		{"1GSa/s", "Sa/s", 1e9, true},
+		{"1e-3", "s", 1e-3, true},
+		{"", "V", 0, false},
+		{"V", "V", 0, false},
+		{"fast", "s", 0, false},
+		{"1.5xs", "s", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseSI(test.text, test.unit)
+		if (err == nil) != test.ok || math.Abs(got-test.want) > 1e-9*math.Abs(test.want) {
+			t.Errorf("parseSI(%q, %q) = %g, %v; want %g (ok %v)", test.text, test.unit, got, err, test.want, test.ok)
+		}
+	}
+}
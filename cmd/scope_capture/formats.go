@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/bmp"
+)
+
+const (
+	defaultFormat      = "png"
+	defaultJPEGQuality = 90
+)
+
+// imageFormatT is an output format for annotated captures.
+type imageFormatT struct {
+	// Ext is the file extension (without the dot) used for the {ext} filename token
+	Ext string
+	// Encode encodes an annotated capture
+	Encode func(img image.Image, options encodeOptionsT) ([]byte, error)
+	// EmbedsMetadata is true if capture metadata is embedded in the file. Otherwise it is
+	// written to a sidecar file.
+	EmbedsMetadata bool
+}
+
+// encodeOptionsT holds the settings which only apply to some formats.
+type encodeOptionsT struct {
+	JPEGQuality int
+}
+
+// imageFormats maps the names accepted by -format to output formats.
+var imageFormats = map[string]imageFormatT{
+	"png":  {Ext: "png", Encode: encodePNG, EmbedsMetadata: true},
+	"png8": {Ext: "png", Encode: encodePalettedPNG, EmbedsMetadata: true},
+	"jpeg": {Ext: "jpg", Encode: encodeJPEG},
+	"gif":  {Ext: "gif", Encode: encodeStillGIF},
+	"bmp":  {Ext: "bmp", Encode: encodeBMP},
+}
+
+// formatExtensions maps file extensions to the format to use for them, so that e.g.
+// "-file shot.jpg" produces a JPEG.
+var formatExtensions = map[string]string{
+	".png":  "png",
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".gif":  "gif",
+	".bmp":  "bmp",
+}
+
+// scopeFormats maps the names accepted by -scope-format to the format parameter of
+// :DISP:DATA?, i.e. the image format the scope sends.
+var scopeFormats = map[string]string{
+	"png":   "PNG",
+	"bmp24": "BMP24",
+	"bmp8":  "BMP8",
+	"jpeg":  "JPEG",
+}
+
+// defaultScopeFormats maps model name prefixes to the format to request from those models when
+// neither -scope-format nor the config file says otherwise. The longest matching prefix wins.
+var defaultScopeFormats = map[string]string{
+	"DS1":  "png",
+	"MSO1": "png",
+}
+
+// selectScopeFormat returns the format to request from a scope: the -scope-format option if
+// given, then the config file's setting for the model, then the built-in default for the model,
+// then PNG.
+func selectScopeFormat(format, model string) (string, error) {
+	if format == "" {
+		format = modelSetting(config.ScopeFormats, model)
+	}
+	if format == "" {
+		format = modelSetting(defaultScopeFormats, model)
+	}
+	if format == "" {
+		format = "png"
+	}
+	format = strings.ToLower(format)
+	if _, ok := scopeFormats[format]; !ok {
+		names := []string{}
+		for name := range scopeFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown scope format %q (expected one of %s)", format, strings.Join(names, ", "))
+	}
+	return format, nil
+}
+
+// modelSetting returns the value in settings whose key is the longest prefix of model (""
+// if there is none).
+func modelSetting(settings map[string]string, model string) string {
+	best, value := -1, ""
+	for prefix, setting := range settings {
+		if strings.HasPrefix(strings.ToUpper(model), strings.ToUpper(prefix)) && len(prefix) > best {
+			best, value = len(prefix), setting
+		}
+	}
+	return value
+}
+
+// formatNames returns the names of the output formats, for usage and error messages.
+func formatNames() string {
+	names := []string{}
+	for name := range imageFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// selectFormat returns the output format: the -format option if given, otherwise the one
+// implied by the filename template's extension, otherwise PNG.
+func selectFormat(format, filenameTemplate string) (string, error) {
+	if format != "" {
+		format = strings.ToLower(format)
+		if _, ok := imageFormats[format]; !ok {
+			return "", fmt.Errorf("unknown format %q (expected one of %s)", format, formatNames())
+		}
+		return format, nil
+	}
+	if implied, ok := formatExtensions[strings.ToLower(filepath.Ext(filenameTemplate))]; ok {
+		return implied, nil
+	}
+	return defaultFormat, nil
+}
+
+func encodePNG(img image.Image, options encodeOptionsT) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
+	}
+	return encoded.Bytes(), nil
+}
+
+// encodePalettedPNG encodes img as an 8 bit palettized PNG, which is a fraction of the size of
+// a true color one since scope screens use few colors. An image with more than 256 colors (e.g.
+// after smooth scaling, or from a JPEG screenshot) would lose some of them, so it is encoded as a
+// true color PNG instead.
+func encodePalettedPNG(img image.Image, options encodeOptionsT) ([]byte, error) {
+	if !fitsPalette(img) {
+		log.InfoPrint("The image has more than 256 colors, so it is written as a true color PNG.")
+		return encodePNG(img, options)
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	var encoded bytes.Buffer
+	if err := encoder.Encode(&encoded, toPaletted(img)); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
+	}
+	return encoded.Bytes(), nil
+}
+
+func encodeJPEG(img image.Image, options encodeOptionsT) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: options.JPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode JPEG: %v", err)
+	}
+	return encoded.Bytes(), nil
+}
+
+func encodeStillGIF(img image.Image, options encodeOptionsT) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := gif.Encode(&encoded, toPaletted(img), nil); err != nil {
+		return nil, fmt.Errorf("failed to encode GIF: %v", err)
+	}
+	return encoded.Bytes(), nil
+}
+
+func encodeBMP(img image.Image, options encodeOptionsT) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := bmp.Encode(&encoded, img); err != nil {
+		return nil, fmt.Errorf("failed to encode BMP: %v", err)
+	}
+	return encoded.Bytes(), nil
+}
+
+// toPaletted converts img to a paletted image using scopePalette, without dithering.
+func toPaletted(img image.Image) *image.Paletted {
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	paletted := image.NewPaletted(rgba.Bounds(), scopePalette([]*image.RGBA{rgba}))
+	draw.Draw(paletted, rgba.Bounds(), rgba, rgba.Bounds().Min, draw.Src)
+	return paletted
+}
+
+// fitsPalette returns whether img has at most 256 distinct colors.
+func fitsPalette(img image.Image) bool {
+	colors := map[color.RGBA]bool{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colors[color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)] = true
+			if len(colors) > 256 {
+				return false
+			}
+		}
+	}
+	return true
+}
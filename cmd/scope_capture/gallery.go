@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	galleryDirName        = "gallery"
+	galleryStateFilename  = "gallery_state.json"
+	galleryThumbsDirName  = "thumbs"
+	galleryThumbnailWidth = 320
+)
+
+// galleryEntryT is the cached information about one capture in the gallery. Entries are kept in
+// the gallery state file so that only new or changed captures are processed on regeneration.
+type galleryEntryT struct {
+	Size    int64          `json:"size"`
+	ModTime time.Time      `json:"mod_time"`
+	Thumb   string         `json:"thumb"`
+	Record  captureRecordT `json:"record"`
+	// HasMetadata is false if the record was made up from the filename and file time
+	HasMetadata bool `json:"has_metadata"`
+	// Derived is set for variants and images derived from captures (e.g. comparisons), which
+	// aren't shown
+	Derived bool `json:"derived,omitempty"`
+}
+
+// galleryGroupT is one page of the gallery.
+type galleryGroupT struct {
+	Title string
+	Page  string
+	Cards []galleryCardT
+}
+
+// galleryCardT is everything needed to render one capture in the gallery.
+type galleryCardT struct {
+	Image        string
+	Thumb        string
+	Time         string
+	Note         string
+	Model        string
+	Serial       string
+	Project      string
+	Labels       []galleryLabelT
+	Measurements [][2]string
+	Settings     [][2]string
+}
+
+type galleryLabelT struct {
+	Text  string
+	Color template.CSS
+}
+
+func runGallery(args []string) error {
+	var flagGalleryOutputDir, flagGalleryDir, flagGroup, flagTitle string
+	var flagRebuild bool
+	fs := newSubcommandFlagSet("gallery", "")
+	fs.StringVar(&flagGalleryOutputDir, "outdir", "",
+		"Output directory whose captures to publish (Defaults as for capturing)")
+	fs.StringVar(&flagGalleryDir, "gallery", "",
+		fmt.Sprintf("Directory to write the gallery to (Defaults to %q inside the output directory)", galleryDirName))
+	fs.StringVar(&flagGroup, "group", "day", "Group captures by \"day\" or \"project\"")
+	fs.StringVar(&flagTitle, "title", "Scope captures", "Gallery title")
+	fs.BoolVar(&flagRebuild, "rebuild", false, "Reprocess every capture rather than only new ones")
+	if positional := parseInterspersed(fs, args); len(positional) > 0 {
+		return fmt.Errorf("unexpected argument %q", positional[0])
+	}
+	if flagGroup != "day" && flagGroup != "project" {
+		return fmt.Errorf("unknown -group %q (expected \"day\" or \"project\")", flagGroup)
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+
+	captureDir, err := indexDirForOutputDir(outputDirTemplate(flagGalleryOutputDir))
+	if err != nil {
+		return err
+	}
+	galleryDir := flagGalleryDir
+	if galleryDir == "" {
+		galleryDir = filepath.Join(captureDir, galleryDirName)
+	}
+	return generateGallery(captureDir, galleryDir, flagGroup, flagTitle, flagRebuild)
+}
+
+// generateGallery writes a static HTML gallery of the captures in captureDir to galleryDir.
+func generateGallery(captureDir, galleryDir, group, title string, rebuild bool) error {
+	thumbsDir := filepath.Join(galleryDir, galleryThumbsDirName)
+	if err := os.MkdirAll(thumbsDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", thumbsDir, err)
+	}
+	statePath := filepath.Join(galleryDir, galleryStateFilename)
+	state := map[string]galleryEntryT{}
+	if !rebuild {
+		if data, err := os.ReadFile(statePath); err == nil {
+			if err := json.Unmarshal(data, &state); err != nil {
+				log.InfoPrintf("WARNING: Ignoring unreadable gallery state %q: %v", statePath, err)
+				state = map[string]galleryEntryT{}
+			}
+		}
+	}
+
+	paths, err := findCaptureImages(captureDir, galleryDir)
+	if err != nil {
+		return err
+	}
+	log.InfoPrintf("Found %d image(s) in %q.", len(paths), captureDir)
+
+	newState := map[string]galleryEntryT{}
+	processed := 0
+	for _, relPath := range paths {
+		path := filepath.Join(captureDir, relPath)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		entry, cached := state[relPath]
+		if cached && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) &&
+			(entry.Derived || fileExists(filepath.Join(galleryDir, entry.Thumb))) {
+			newState[relPath] = entry
+			continue
+		}
+		entry, err = processGalleryCapture(captureDir, thumbsDir, relPath, info)
+		if err != nil {
+			log.InfoPrintf("WARNING: Skipping %q: %v", path, err)
+			continue
+		}
+		if !entry.Derived {
+			entry.Thumb = filepath.ToSlash(filepath.Join(galleryThumbsDirName, filepath.Base(entry.Thumb)))
+		}
+		newState[relPath] = entry
+		processed++
+	}
+	// Remove the thumbnails of captures which no longer exist
+	for relPath, entry := range state {
+		if _, ok := newState[relPath]; !ok && entry.Thumb != "" {
+			os.Remove(filepath.Join(galleryDir, entry.Thumb))
+		}
+	}
+	log.InfoPrintf("Processed %d new or changed capture(s).", processed)
+
+	groups, err := buildGalleryGroups(captureDir, galleryDir, newState, group)
+	if err != nil {
+		return err
+	}
+	if err := writeGalleryPages(galleryDir, title, groups); err != nil {
+		return err
+	}
+
+	stateData, err := json.MarshalIndent(newState, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(statePath, stateData); err != nil {
+		return err
+	}
+	log.InfoPrintf("Wrote gallery to %q.", filepath.Join(galleryDir, "index.html"))
+	return nil
+}
+
+// findCaptureImages returns the images below captureDir (relative to it) which may be annotated
+// captures, skipping raw captures and the gallery itself.
+func findCaptureImages(captureDir, galleryDir string) ([]string, error) {
+	galleryAbs, _ := filepath.Abs(galleryDir)
+	paths := []string{}
+	err := filepath.WalkDir(captureDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, _ := filepath.Abs(path); abs == galleryAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isCaptureImage(d.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(captureDir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, relPath)
+		return nil
+	})
+	return paths, err
+}
+
+// isCaptureImage reports whether name may be an annotated capture: an image which isn't a raw
+// capture. Variants and images derived from captures (e.g. comparisons) can only be told apart
+// by their metadata.
+func isCaptureImage(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, "raw_scope_capture.") || strings.HasPrefix(lower, ".") {
+		return false
+	}
+	ext := filepath.Ext(lower)
+	if strings.HasSuffix(strings.TrimSuffix(lower, ext), ".raw") {
+		return false
+	}
+	_, ok := formatExtensions[ext]
+	return ok
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// processGalleryCapture reads the metadata of a capture and writes its thumbnail.
+func processGalleryCapture(captureDir, thumbsDir, relPath string, info fs.FileInfo) (galleryEntryT, error) {
+	path := filepath.Join(captureDir, relPath)
+	entry := galleryEntryT{Size: info.Size(), ModTime: info.ModTime()}
+	record, ok, err := readCaptureMetadata(path)
+	if err != nil {
+		log.InfoPrintf("WARNING: Unable to read metadata from %q: %v", path, err)
+	}
+	if !ok {
+		record = captureRecordT{Time: info.ModTime()}
+	}
+	if record.Kind != "" || isVariant(record, path) {
+		entry.Derived = true
+		return entry, nil
+	}
+	record.Path = filepath.ToSlash(relPath)
+	entry.Record = record
+	entry.HasMetadata = ok
+
+	img, err := decodeImageFile(path)
+	if err != nil {
+		return entry, err
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, thumbnail(img, galleryThumbnailWidth)); err != nil {
+		return entry, err
+	}
+	// Name thumbnails after the capture's path so that captures with the same name in
+	// different folders don't collide.
+	entry.Thumb = makeFilenameSafe(strings.ReplaceAll(filepath.ToSlash(relPath), "/", "__")) + ".thumb.png"
+	if err := writeFileAtomic(filepath.Join(thumbsDir, entry.Thumb), encoded.Bytes()); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// thumbnail scales img down (preserving aspect ratio) to the given width.
+func thumbnail(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, xdraw.Src, nil)
+	return thumb
+}
+
+// buildGalleryGroups sorts the gallery entries into pages.
+func buildGalleryGroups(captureDir, galleryDir string, entries map[string]galleryEntryT, group string) ([]galleryGroupT, error) {
+	relCaptureDir, err := filepath.Rel(galleryDir, captureDir)
+	if err != nil {
+		return nil, err
+	}
+	sorted := []galleryEntryT{}
+	for _, entry := range entries {
+		if !entry.Derived {
+			sorted = append(sorted, entry)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Record.Time.After(sorted[j].Record.Time)
+	})
+
+	byTitle := map[string]*galleryGroupT{}
+	groups := []*galleryGroupT{}
+	for _, entry := range sorted {
+		record := entry.Record
+		title := record.Time.Local().Format("2006-01-02")
+		if group == "project" {
+			title = record.Project
+			if title == "" {
+				title = "(No project)"
+			}
+		}
+		g, ok := byTitle[title]
+		if !ok {
+			g = &galleryGroupT{Title: title}
+			byTitle[title] = g
+			groups = append(groups, g)
+		}
+		card := galleryCardT{
+			Image:   filepath.ToSlash(filepath.Join(relCaptureDir, record.Path)),
+			Thumb:   entry.Thumb,
+			Time:    record.Time.Local().Format("2006-01-02 15:04:05"),
+			Note:    record.Note,
+			Model:   record.Instrument.Model,
+			Serial:  record.Instrument.Serial,
+			Project: record.Project,
+		}
+		if card.Note == "" {
+			card.Note = filepath.Base(record.Path)
+		}
+		for _, label := range record.Labels {
+			card.Labels = append(card.Labels, galleryLabelT{
+				Text: label.String(), Color: template.CSS(colorHex(sourceColor(label.Source))),
+			})
+		}
+		card.Measurements = measurementRows(record.Measurements)
+		card.Settings = sortedSettings(record.Settings)
+		g.Cards = append(g.Cards, card)
+	}
+	if group == "project" {
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Title < groups[j].Title })
+	}
+
+	// Titles which differ only in characters which aren't filename-safe (or in case) would share
+	// a page, so number all but the first
+	pages := map[string]bool{}
+	result := []galleryGroupT{}
+	for _, g := range groups {
+		name := group + "-" + makeFilenameSafe(g.Title)
+		g.Page = name + ".html"
+		for n := 2; pages[strings.ToLower(g.Page)]; n++ {
+			g.Page = fmt.Sprintf("%s_%d.html", name, n)
+		}
+		pages[strings.ToLower(g.Page)] = true
+		result = append(result, *g)
+	}
+	return result, nil
+}
+
+// colorHex returns a CSS hex color, e.g. "#f7fa52".
+func colorHex(c color.Color) string {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	return fmt.Sprintf("#%02x%02x%02x", rgba.R, rgba.G, rgba.B)
+}
+
+// writeGalleryPages writes the gallery index page and one page per group.
+func writeGalleryPages(galleryDir, title string, groups []galleryGroupT) error {
+	generated := time.Now().Format("2006-01-02 15:04:05")
+	var page bytes.Buffer
+	err := galleryIndexTemplate.Execute(&page, map[string]any{
+		"Title": title, "Groups": groups, "Generated": generated, "Version": versionInfo(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(galleryDir, "index.html"), page.Bytes()); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		page.Reset()
+		err := galleryGroupTemplate.Execute(&page, map[string]any{
+			"Title": title, "Group": g, "Generated": generated, "Version": versionInfo(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(galleryDir, g.Page), page.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const galleryStyle = `
+body { background: #111; color: #ddd; font-family: sans-serif; margin: 2em; }
+a { color: #7cf; }
+.grid { display: flex; flex-wrap: wrap; gap: 1em; }
+.card { background: #222; border-radius: 6px; padding: 0.6em; width: 320px; }
+.card img { width: 320px; display: block; }
+.note { font-weight: bold; margin: 0.4em 0 0.2em 0; }
+.meta { font-size: 0.85em; color: #aaa; }
+.label { font-family: monospace; font-size: 0.9em; }
+table { font-size: 0.8em; border-collapse: collapse; }
+td { padding: 0 0.6em 0 0; }
+footer { margin-top: 2em; font-size: 0.8em; color: #777; }
+`
+
+var galleryIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title><style>` + galleryStyle + `</style></head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="grid">
+{{range .Groups}}<div class="card">
+<a href="{{.Page}}">{{with index .Cards 0}}<img src="{{.Thumb}}" loading="lazy" alt="">{{end}}</a>
+<div class="note"><a href="{{.Page}}">{{.Title}}</a></div>
+<div class="meta">{{len .Cards}} capture(s)</div>
+</div>
+{{end}}</div>
+<footer>Generated {{.Generated}} by {{.Version}}</footer>
+</body></html>
+`))
+
+var galleryGroupTemplate = template.Must(template.New("group").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Group.Title}} - {{.Title}}</title><style>` + galleryStyle + `</style></head>
+<body>
+<p><a href="index.html">{{.Title}}</a></p>
+<h1>{{.Group.Title}}</h1>
+<div class="grid">
+{{range .Group.Cards}}<div class="card">
+<a href="{{.Image}}"><img src="{{.Thumb}}" loading="lazy" alt="{{.Note}}"></a>
+<div class="note">{{.Note}}</div>
+<div class="meta">{{.Time}}{{if .Model}} &middot; {{.Model}} {{.Serial}}{{end}}{{if .Project}} &middot; {{.Project}}{{end}}</div>
+{{range .Labels}}<div class="label" style="color: {{.Color}}">{{.Text}}</div>
+{{end}}{{if .Measurements}}<table>
+{{range .Measurements}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>{{end}}{{if .Settings}}<details><summary class="meta">Settings</summary><table>
+{{range .Settings}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table></details>{{end}}
+</div>
+{{end}}</div>
+<footer>Generated {{.Generated}} by {{.Version}}</footer>
+</body></html>
+`))
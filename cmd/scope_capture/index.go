@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const indexFilename = "index.jsonl"
+
+// captureRecordT describes a single capture. One is appended (as a line of JSON) to the index
+// file for every capture.
+type captureRecordT struct {
+	// Path is the annotated image, relative to the directory containing the index
+	Path       string            `json:"path"`
+	Time       time.Time         `json:"time"`
+	Session    string            `json:"session"`
+	Host       string            `json:"host"`
+	Project    string            `json:"project,omitempty"`
+	Instrument instrumentT       `json:"instrument"`
+	Scope      string            `json:"scope,omitempty"`
+	Layout     string            `json:"layout,omitempty"`
+	Note       string            `json:"note,omitempty"`
+	Labels     []labelT          `json:"labels,omitempty"`
+	Settings   map[string]string `json:"settings,omitempty"`
+	Theme      string            `json:"theme,omitempty"`
+	Drawings   []drawingT        `json:"drawings,omitempty"`
+	Recipe     string            `json:"recipe,omitempty"`
+	Procedure  string            `json:"procedure,omitempty"`
+	SHA256     string            `json:"sha256"`
+	// Measurements are those read when the capture was made
+	Measurements []measurementT `json:"measurements,omitempty"`
+	// Waveforms is the waveform CSV (if any), relative to the directory containing the image
+	Waveforms string `json:"waveforms,omitempty"`
+	// Variants are the variant images (if any), relative to the directory containing the image
+	Variants []string `json:"variants,omitempty"`
+	// Setup is the scope's binary setup (:SYST:SET?), if embedded. It is not kept in the index.
+	Setup []byte `json:"setup,omitempty"`
+	// Kind is set (e.g. to "comparison") for an image derived from captures rather than a
+	// capture. Such images aren't indexed, and the gallery and reports skip them.
+	Kind string `json:"kind,omitempty"`
+}
+
+// indexDirForOutputDir returns the directory holding the index for an output directory
+// template. The index lives at the root of the output directory: the part of the template
+// before the first token, so that e.g. "~/captures/{project}/{yyyy-mm-dd}" shares a single index
+// at "~/captures".
+func indexDirForOutputDir(outputDirTemplate string) (string, error) {
+	dir := outputDirTemplate
+	if i := strings.Index(dir, "{"); i >= 0 {
+		dir = dir[:i]
+		if j := strings.LastIndexAny(dir, `/\`); j >= 0 {
+			dir = dir[:j+1]
+		} else {
+			dir = "."
+		}
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return resolveOutputDir(dir, templateContextT{})
+}
+
+// sha256Hex returns the hex encoded SHA-256 digest of data.
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// appendToIndex appends record to the index in indexDir. record.Path is converted to be
+// relative to indexDir, and any embedded setup is left out.
+func appendToIndex(indexDir string, record captureRecordT) error {
+	record.Setup = nil
+	if relPath, err := filepath.Rel(indexDir, record.Path); err == nil {
+		record.Path = filepath.ToSlash(relPath)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode index entry: %v", err)
+	}
+	indexPath := filepath.Join(indexDir, indexFilename)
+	// A single write of a whole line to a file opened with O_APPEND, so that concurrent captures
+	// into the same directory don't interleave their entries.
+	file, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open index %q: %v", indexPath, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write index %q: %v", indexPath, err)
+	}
+	log.InfoPrintf("Added capture to index %q.", indexPath)
+	return nil
+}
+
+// loadIndex reads every record in the index in indexDir. Record paths are left relative to
+// indexDir. If an image has been indexed more than once (e.g. after re-annotating it) then the
+// latest entry replaces the earlier ones. A missing index is not an error.
+func loadIndex(indexDir string) ([]captureRecordT, error) {
+	indexPath := filepath.Join(indexDir, indexFilename)
+	file, err := os.Open(indexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.InfoPrintf("No index found at %q.", indexPath)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %v", err)
+	}
+	defer file.Close()
+
+	records := []captureRecordT{}
+	recordIndex := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record captureRecordT
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			log.InfoPrintf("WARNING: Skipping bad index entry at %s:%d: %v", indexPath, lineNumber, err)
+			continue
+		}
+		if i, ok := recordIndex[record.Path]; ok {
+			records[i] = record
+			continue
+		}
+		recordIndex[record.Path] = len(records)
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// indexFilterT selects records from the index. Zero valued fields match everything.
+type indexFilterT struct {
+	Text    string
+	From    time.Time
+	To      time.Time
+	Serial  string
+	Label   string
+	Session string
+}
+
+// matches reports whether record passes every filter. Text comparisons are case insensitive.
+func (f indexFilterT) matches(record captureRecordT) bool {
+	if !f.From.IsZero() && record.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !record.Time.Before(f.To) {
+		return false
+	}
+	if f.Serial != "" && !strings.EqualFold(record.Instrument.Serial, f.Serial) {
+		return false
+	}
+	if f.Session != "" && record.Session != f.Session {
+		return false
+	}
+	if f.Label != "" && !matchesLabel(record.Labels, f.Label) {
+		return false
+	}
+	if f.Text != "" {
+		haystack := []string{record.Path, record.Note, record.Host, record.Session,
+			record.Instrument.Manufacturer, record.Instrument.Model, record.Instrument.Serial}
+		for _, label := range record.Labels {
+			haystack = append(haystack, label.String())
+		}
+		if !containsFold(strings.Join(haystack, "\n"), f.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesLabel reports whether any label matches query, which is either label text or
+// SOURCE=TEXT to match the text of a particular source's label.
+func matchesLabel(labels []labelT, query string) bool {
+	source := ""
+	if label, err := parseLabel(query); err == nil {
+		source, query = label.Source, label.Text
+	}
+	for _, label := range labels {
+		if (source == "" || label.Source == source) && containsFold(label.Text, query) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// parseDateFlag parses a -from/-to date given as "2006-01-02", "2006-01-02T15:04" or RFC 3339.
+// If endOfDay is set then a bare date refers to the end of that day.
+func parseDateFlag(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse date %q (expected e.g. 2025-01-16 or 2025-01-16T19:24)", value)
+}
+
+// indexQueryFlagsT holds the command line options used to select captures from the index.
+type indexQueryFlagsT struct {
+	outputDir string
+	text      string
+	from      string
+	to        string
+	serial    string
+	label     string
+	session   string
+}
+
+func (q *indexQueryFlagsT) register(fs *flag.FlagSet) {
+	fs.StringVar(&q.outputDir, "outdir", "", "Output directory containing the index (Defaults as for capturing)")
+	fs.StringVar(&q.text, "text", "", "Only captures whose note, labels, path or instrument contain this text")
+	fs.StringVar(&q.from, "from", "", "Only captures taken at or after this date/time (e.g. 2025-01-16 or 2025-01-16T09:00)")
+	fs.StringVar(&q.to, "to", "", "Only captures taken before the end of this date, or before this date/time")
+	fs.StringVar(&q.serial, "serial", "", "Only captures from the instrument with this serial number")
+	fs.StringVar(&q.label, "label", "", "Only captures with a label containing this text (or SOURCE=TEXT)")
+	fs.StringVar(&q.session, "session", "", "Only captures from this session ID")
+}
+
+// query loads the index and returns the matching records, along with the index directory
+// (which record paths are relative to).
+func (q *indexQueryFlagsT) query() ([]captureRecordT, string, error) {
+	var filter indexFilterT
+	var err error
+	filter.Text, filter.Serial, filter.Label, filter.Session = q.text, q.serial, q.label, q.session
+	if filter.From, err = parseDateFlag(q.from, false); err != nil {
+		return nil, "", err
+	}
+	if filter.To, err = parseDateFlag(q.to, true); err != nil {
+		return nil, "", err
+	}
+	indexDir, err := indexDirForOutputDir(outputDirTemplate(q.outputDir))
+	if err != nil {
+		return nil, "", err
+	}
+	records, err := loadIndex(indexDir)
+	if err != nil {
+		return nil, "", err
+	}
+	matched := []captureRecordT{}
+	for _, record := range records {
+		if filter.matches(record) {
+			matched = append(matched, record)
+		}
+	}
+	return matched, indexDir, nil
+}
+
+func runList(args []string) error {
+	return runIndexQuery("list", args)
+}
+
+func runSearch(args []string) error {
+	return runIndexQuery("search", args)
+}
+
+// runIndexQuery implements the list and search subcommands, which differ only in that search
+// treats any positional arguments as search text.
+func runIndexQuery(name string, args []string) error {
+	var q indexQueryFlagsT
+	var flagJSON bool
+	fs := newSubcommandFlagSet(name, "[TEXT...]")
+	q.register(fs)
+	fs.BoolVar(&flagJSON, "json", false, "Print matching captures as JSON")
+	positional := parseInterspersed(fs, args)
+	if len(positional) > 0 {
+		if name != "search" {
+			return fmt.Errorf("unexpected argument %q", positional[0])
+		}
+		q.text = strings.TrimSpace(q.text + " " + strings.Join(positional, " "))
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+
+	records, _, err := q.query()
+	if err != nil {
+		return err
+	}
+	log.InfoPrintf("%d matching capture(s).", len(records))
+	if flagJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tMODEL\tSERIAL\tNOTE\tLABELS\tPATH")
+	for _, record := range records {
+		labels := []string{}
+		for _, label := range record.Labels {
+			labels = append(labels, label.String())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			record.Time.Local().Format("2006-01-02 15:04:05"), record.Instrument.Model,
+			record.Instrument.Serial, record.Note, strings.Join(labels, ", "), record.Path)
+	}
+	return w.Flush()
+}
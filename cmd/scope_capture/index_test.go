@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadIndex(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2025, 1, 16, 9, 0, 0, 0, time.UTC)
+	entries := []captureRecordT{
+		{Path: filepath.Join(dir, "b.png"), Time: start.Add(2 * time.Minute), Note: "b"},
+		{Path: filepath.Join(dir, "a.png"), Time: start.Add(time.Minute), Note: "a", Setup: []byte("setup")},
+		// Re-annotated, so replaces the first entry for b.png
+		{Path: filepath.Join(dir, "b.png"), Time: start.Add(2 * time.Minute), Note: "b, corrected"},
+		{Path: filepath.Join(dir, "day", "c.png"), Time: start, Note: "c"},
+	}
+	for _, entry := range entries {
+		if err := appendToIndex(dir, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A damaged line is skipped rather than losing the whole index
+	file, err := os.OpenFile(filepath.Join(dir, indexFilename), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{\"path\": \"broken\n\n")
+	file.Close()
+
+	records, err := loadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ path, note string }{
+		{"day/c.png", "c"},
+		{"a.png", "a"},
+		{"b.png", "b, corrected"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("loadIndex() returned %d records, want %d: %+v", len(records), len(want), records)
+	}
+	for i, w := range want {
+		if records[i].Path != w.path || records[i].Note != w.note {
+			t.Errorf("record %d is %q (%q), want %q (%q)", i, records[i].Path, records[i].Note, w.path, w.note)
+		}
+		if records[i].Setup != nil {
+			t.Errorf("record %d has a setup, which shouldn't be indexed", i)
+		}
+	}
+}
+
+func TestLoadIndexMissing(t *testing.T) {
+	records, err := loadIndex(t.TempDir())
+	if err != nil || len(records) != 0 {
+		t.Errorf("loadIndex() = %v, %v; want no records and no error", records, err)
+	}
+}
+
+func TestIndexDirForOutputDir(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", "."},
+		{"scope_captures", "scope_captures"},
+		{"captures/{project}/{yyyy-mm-dd}", "captures/"},
+		{"/data/captures/{date}", "/data/captures/"},
+		{"{project}", "."},
+		{"captures_{date}", "."},
+	}
+	for _, test := range tests {
+		got, err := indexDirForOutputDir(test.template)
+		if err != nil || filepath.Clean(got) != filepath.Clean(test.want) {
+			t.Errorf("indexDirForOutputDir(%q) = %q, %v; want %q", test.template, got, err, test.want)
+		}
+	}
+}
+
+func TestIndexFilterMatches(t *testing.T) {
+	record := captureRecordT{
+		Path:       "2025-01-16/Startup.png",
+		Time:       time.Date(2025, 1, 16, 19, 24, 33, 0, time.Local),
+		Session:    "20250116-192433-3f9a",
+		Instrument: instrumentT{Model: "DS1054Z", Serial: "DS1ZA221102281"},
+		Note:       "Startup ramp",
+		Labels:     []labelT{{Source: "CH1", Text: "Vin"}, {Source: "CH2", Text: "Vout"}},
+	}
+	day := func(value string, endOfDay bool) time.Time {
+		t.Helper()
+		date, err := parseDateFlag(value, endOfDay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return date
+	}
+	tests := []struct {
+		name   string
+		filter indexFilterT
+		want   bool
+	}{
+		{"everything", indexFilterT{}, true},
+		{"note text, ignoring case", indexFilterT{Text: "STARTUP"}, true},
+		{"label text", indexFilterT{Text: "ch2: vout"}, true},
+		{"other text", indexFilterT{Text: "shutdown"}, false},
+		{"on the day", indexFilterT{From: day("2025-01-16", false), To: day("2025-01-16", true)}, true},
+		{"the day before", indexFilterT{To: day("2025-01-15", true)}, false},
+		{"the day after", indexFilterT{From: day("2025-01-17", false)}, false},
+		{"at the minute", indexFilterT{From: day("2025-01-16T19:24", false)}, true},
+		{"serial", indexFilterT{Serial: "ds1za221102281"}, true},
+		{"other serial", indexFilterT{Serial: "DS1ZA000000000"}, false},
+		{"session", indexFilterT{Session: "20250116-192433-3f9a"}, true},
+		{"other session", indexFilterT{Session: "20250116-192433"}, false},
+		{"any label", indexFilterT{Label: "vout"}, true},
+		{"source's label", indexFilterT{Label: "CH2=vout"}, true},
+		{"other source's label", indexFilterT{Label: "CH1=vout"}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.matches(record); got != test.want {
+			t.Errorf("%s: matches() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxAnalogChannel  = 4
+	maxDigitalChannel = 15
+	maxRefChannel     = 10
+)
+
+var (
+	colorNote = color.RGBA{176, 176, 176, 255} // Gray
+
+	// colorSources holds the annotation color for each source kind, matching the trace colors
+	// the scope uses on screen.
+	colorSources = map[string]color.Color{
+		"CH1":  color.RGBA{247, 250, 82, 255}, // Yellow
+		"CH2":  color.RGBA{0, 225, 221, 255},  // Cyan
+		"CH3":  color.RGBA{221, 0, 221, 255},  // Magenta
+		"CH4":  color.RGBA{0, 127, 245, 255},  // Blue
+		"MATH": color.RGBA{180, 90, 255, 255}, // Purple
+		"REF":  color.RGBA{255, 140, 0, 255},  // Orange
+		"D":    color.RGBA{0, 210, 0, 255},    // Green
+	}
+)
+
+// labelT is a single annotation label attached to a signal source.
+type labelT struct {
+	// Source is the canonical source name, e.g. "CH1", "MATH", "REF2", "D3" or "D0-D7"
+	Source string `json:"source"`
+	Text   string `json:"text"`
+}
+
+// String returns the label as it is drawn on the image.
+func (l labelT) String() string {
+	return fmt.Sprintf("%s: %s", l.Source, l.Text)
+}
+
+// labelsFlag collects repeated `-label SOURCE=TEXT` command line arguments.
+type labelsFlag []labelT
+
+func (l *labelsFlag) String() string {
+	items := []string{}
+	for _, label := range *l {
+		items = append(items, label.Source+"="+label.Text)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *labelsFlag) Set(value string) error {
+	label, err := parseLabel(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, label)
+	return nil
+}
+
+// parseLabel parses a `SOURCE=TEXT` label specification.
+func parseLabel(spec string) (labelT, error) {
+	source, text, found := strings.Cut(spec, "=")
+	if !found {
+		return labelT{}, fmt.Errorf("label %q is not of the form SOURCE=TEXT", spec)
+	}
+	source, err := canonicalSource(source)
+	if err != nil {
+		return labelT{}, err
+	}
+	return labelT{Source: source, Text: text}, nil
+}
+
+// canonicalSource converts a user supplied source name (e.g. "ch1", "CHAN1", "math", "d0-d7")
+// to its canonical form (e.g. "CH1", "CH1", "MATH", "D0-D7").
+func canonicalSource(source string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(source))
+	switch {
+	case s == "MATH":
+		return s, nil
+	case s == "REF":
+		return s, nil
+	case strings.HasPrefix(s, "REF"):
+		n, err := sourceNumber(s[3:])
+		if err != nil || n < 1 || n > maxRefChannel {
+			return "", fmt.Errorf("invalid reference source %q", source)
+		}
+		return fmt.Sprintf("REF%d", n), nil
+	case strings.HasPrefix(s, "CHAN"), strings.HasPrefix(s, "CH"):
+		number := strings.TrimPrefix(s, "CH")
+		if strings.HasPrefix(s, "CHAN") {
+			number = strings.TrimPrefix(s, "CHAN")
+		}
+		n, err := sourceNumber(number)
+		if err != nil || n < 1 || n > maxAnalogChannel {
+			return "", fmt.Errorf("invalid analog channel source %q", source)
+		}
+		return fmt.Sprintf("CH%d", n), nil
+	case strings.HasPrefix(s, "D"):
+		first, last, isRange := strings.Cut(s, "-")
+		lo, err := digitalChannel(first)
+		if err != nil {
+			return "", fmt.Errorf("invalid digital source %q", source)
+		}
+		if !isRange {
+			return fmt.Sprintf("D%d", lo), nil
+		}
+		hi, err := digitalChannel(last)
+		if err != nil || hi < lo {
+			return "", fmt.Errorf("invalid digital source range %q", source)
+		}
+		return fmt.Sprintf("D%d-D%d", lo, hi), nil
+	}
+	return "", fmt.Errorf("unknown source %q (expected CH1-CH%d, MATH, REF, REF1-REF%d or D0-D%d)",
+		source, maxAnalogChannel, maxRefChannel, maxDigitalChannel)
+}
+
+// sourceNumber parses the channel number of a source name, which must be all digits (so no sign
+// or spaces).
+func sourceNumber(s string) (int, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid channel number %q", s)
+	}
+	return strconv.Atoi(s)
+}
+
+func digitalChannel(s string) (int, error) {
+	n, err := sourceNumber(strings.TrimPrefix(s, "D"))
+	if err != nil || !strings.HasPrefix(s, "D") || n < 0 || n > maxDigitalChannel {
+		return 0, fmt.Errorf("invalid digital channel %q", s)
+	}
+	return n, nil
+}
+
+// sourceKind returns the key into colorSources for a canonical source name.
+func sourceKind(source string) string {
+	switch {
+	case strings.HasPrefix(source, "REF"):
+		return "REF"
+	case strings.HasPrefix(source, "D"):
+		return "D"
+	}
+	return source
+}
+
+// sourceColor returns the annotation color for a canonical source name: a color from the config
+// file for the source or its kind if there is one, otherwise the palette's color for its kind.
+func sourceColor(source string) color.Color {
+	if col, ok := config.Colors[source]; ok {
+		return col
+	}
+	if col, ok := config.Colors[sourceKind(source)]; ok {
+		return col
+	}
+	palette, ok := palettes[strings.ToLower(config.Palette)]
+	if !ok {
+		palette = palettes[defaultPaletteName]
+	}
+	if col, ok := palette[sourceKind(source)]; ok {
+		return col
+	}
+	return colorNote
+}
+
+// sourceRank orders sources the way the scope lists them: analog channels, math, references,
+// then digital channels.
+func sourceRank(source string) int {
+	var n int
+	switch sourceKind(source) {
+	case "MATH":
+		return 100
+	case "REF":
+		fmt.Sscanf(source, "REF%d", &n)
+		return 200 + n
+	case "D":
+		fmt.Sscanf(source, "D%d", &n)
+		return 300 + n
+	}
+	fmt.Sscanf(source, "CH%d", &n)
+	return n
+}
+
+// mergeLabels combines the legacy per-channel labels (-l1 .. -l4) with the generalized
+// -label entries. A -label entry replaces a legacy label for the same source. Empty labels are
+// dropped and the result is sorted into scope order.
+func mergeLabels(channelLabels []string, labels []labelT) []labelT {
+	bySource := map[string]labelT{}
+	for i, text := range channelLabels {
+		source := fmt.Sprintf("CH%d", i+1)
+		bySource[source] = labelT{Source: source, Text: text}
+	}
+	for _, label := range labels {
+		bySource[label.Source] = label
+	}
+	merged := []labelT{}
+	for _, label := range bySource {
+		if label.Text != "" {
+			merged = append(merged, label)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return sourceRank(merged[i].Source) < sourceRank(merged[j].Source)
+	})
+	return merged
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalSource(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+		ok     bool
+	}{
+		{"CH1", "CH1", true},
+		{" ch2 ", "CH2", true},
+		{"chan3", "CH3", true},
+		{"CHAN4", "CH4", true},
+		{"CH01", "CH1", true},
+		{"math", "MATH", true},
+		{"ref", "REF", true},
+		{"Ref10", "REF10", true},
+		{"d0", "D0", true},
+		{"D15", "D15", true},
+		{"d0-d7", "D0-D7", true},
+		{"D3-D3", "D3-D3", true},
+		{"CH0", "", false},
+		{"CH5", "", false},
+		{"CH", "", false},
+		{"CHAN", "", false},
+		{"CH+1", "", false},
+		{"CH 1", "", false},
+		{"CHCH1", "", false},
+		{"CHANCH1", "", false},
+		{"REF0", "", false},
+		{"REF11", "", false},
+		{"REFX", "", false},
+		{"D", "", false},
+		{"D16", "", false},
+		{"D7-D0", "", false},
+		{"D0-", "", false},
+		{"D0-7", "", false},
+		{"NC1", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		got, err := canonicalSource(test.source)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("canonicalSource(%q) = %q, %v; want %q (ok %v)", test.source, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseLabel(t *testing.T) {
+	tests := []struct {
+		spec string
+		want labelT
+		ok   bool
+	}{
+		{"CH1=Vin", labelT{Source: "CH1", Text: "Vin"}, true},
+		{"math=A-B", labelT{Source: "MATH", Text: "A-B"}, true},
+		{"d0-d7=Data bus", labelT{Source: "D0-D7", Text: "Data bus"}, true},
+		{"CH2=", labelT{Source: "CH2", Text: ""}, true},
+		{"CH3=a=b", labelT{Source: "CH3", Text: "a=b"}, true},
+		{"CH1", labelT{}, false},
+		{"CH9=x", labelT{}, false},
+		{"=x", labelT{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseLabel(test.spec)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseLabel(%q) = %+v, %v; want %+v (ok %v)", test.spec, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	tests := []struct {
+		name          string
+		channelLabels []string
+		labels        []labelT
+		want          []labelT
+	}{
+		{
+			name: "none",
+			want: []labelT{},
+		},
+		{
+			name:          "legacy labels only, empty ones dropped",
+			channelLabels: []string{"Vin", "", "Vout", ""},
+			want:          []labelT{{"CH1", "Vin"}, {"CH3", "Vout"}},
+		},
+		{
+			name:          "-label replaces the legacy label for its source",
+			channelLabels: []string{"Vin", "Iin"},
+			labels:        []labelT{{"CH2", "Current"}},
+			want:          []labelT{{"CH1", "Vin"}, {"CH2", "Current"}},
+		},
+		{
+			name:          "an empty -label removes a legacy label",
+			channelLabels: []string{"Vin", "Iin"},
+			labels:        []labelT{{"CH1", ""}},
+			want:          []labelT{{"CH2", "Iin"}},
+		},
+		{
+			name:   "sorted into scope order",
+			labels: []labelT{{"D8-D15", "High"}, {"REF2", "Golden"}, {"D0-D7", "Low"}, {"MATH", "Sum"}, {"REF", "Ref"}, {"CH4", "Clock"}},
+			want:   []labelT{{"CH4", "Clock"}, {"MATH", "Sum"}, {"REF", "Ref"}, {"REF2", "Golden"}, {"D0-D7", "Low"}, {"D8-D15", "High"}},
+		},
+	}
+	for _, test := range tests {
+		got := mergeLabels(test.channelLabels, test.labels)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mergeLabels() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"sort"
+	"strings"
+)
+
+const defaultLayoutName = "ds1000z"
+
+// layoutT describes where things are on a particular scope's screen capture, and therefore
+// where annotations can be drawn.
+type layoutT struct {
+	Name string
+	// Size is the screen capture size in pixels
+	Size image.Point
+	// EraseRects are blanked before annotating (logo, on-screen menus, etc.)
+	EraseRects []image.Rectangle
+	// TimestampOrigin is the top left corner of the (two line) capture timestamp
+	TimestampOrigin image.Point
+	// LabelAreas are the (erased) areas in which rotated note and labels are drawn. Areas are
+	// filled in order, and each area is filled from right to left.
+	LabelAreas []image.Rectangle
+	// Regions are the named areas an output image can be cropped to (in addition to "full").
+	// The "graticule" region must include the outer grid lines.
+	Regions map[string]image.Rectangle
+	// Divisions is the number of horizontal and vertical graticule divisions
+	Divisions image.Point
+	// MaskRects are ignored when checking a capture against a golden image, because they change
+	// from one capture to the next (status, timestamp, measurement results, etc.)
+	MaskRects []image.Rectangle
+}
+
+var layouts = map[string]*layoutT{
+	"ds1000z": {
+		Name: "ds1000z",
+		Size: image.Pt(800, 480),
+		EraseRects: []image.Rectangle{
+			image.Rect(3, 8, 80, 28),       // Logo
+			image.Rect(0, 37, 59, 450),     // Left menu
+			image.Rect(705, 38, 799, 436),  // Right menu items
+			image.Rect(690, 39, 704, 117),  // Right menu tab text
+			image.Rect(762, 456, 799, 479), // Lower right icon
+		},
+		TimestampOrigin: image.Pt(2, 2),
+		LabelAreas: []image.Rectangle{
+			image.Rect(705, 38, 799, 436), // Right menu items
+			image.Rect(0, 37, 59, 450),    // Left menu
+		},
+		Regions: map[string]image.Rectangle{
+			"graticule":        image.Rect(84, 38, 685, 439),
+			"graticule+labels": image.Rect(0, 37, 800, 450),
+		},
+		Divisions: image.Pt(12, 8),
+		MaskRects: []image.Rectangle{
+			image.Rect(0, 0, 800, 37),     // Status bar (and the capture timestamp)
+			image.Rect(59, 437, 705, 456), // Measurement results
+		},
+	},
+}
+
+// layoutNames returns the names of the layouts, for error messages.
+func layoutNames() string {
+	names := []string{}
+	for name := range layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// layoutForImage returns the layout to use when annotating img: the named one (e.g. recorded with
+// a capture) or, if name is "", the selected scope's if it has one, otherwise the default.
+func layoutForImage(img image.Image, name string) *layoutT {
+	if name == "" {
+		name = config.Layout
+	}
+	if name == "" {
+		name = defaultLayoutName
+	}
+	layout, ok := layouts[name]
+	if !ok {
+		log.InfoPrintf("WARNING: Unknown layout %q; using %q.", name, defaultLayoutName)
+		layout = layouts[defaultLayoutName]
+	}
+	if img.Bounds().Size() != layout.Size {
+		log.InfoPrintf("WARNING: Image size %v does not match the %q layout size %v.",
+			img.Bounds().Size(), layout.Name, layout.Size)
+	}
+	return layout
+}
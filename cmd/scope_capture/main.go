@@ -3,18 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
-	"errors"
 	"flag"
 	"fmt"
 	"hash/crc32"
 	"image"
 	"image/color"
 	"image/draw"
-	"image/png"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"scopecapture/pkg/moduleconfig"
 	"scopecapture/pkg/quicklog"
 	"strconv"
@@ -39,31 +39,63 @@ var (
 	flagDebug         bool
 	flagScopeHostname string
 	flagScopePort     int
+	flagScope         string
+	flagScopes        string
 	flagFilename      string
 	flagNote          string
 	flagLabel1        string
 	flagLabel2        string
 	flagLabel3        string
 	flagLabel4        string
+	flagLabels        labelsFlag
+	flagOutputDir     string
+	flagProject       string
+	flagKeepRaw       bool
+	flagEmbedSetup    bool
+	flagRecipe        string
+	flagMeasure       string
+	flagFormat        string
+	flagJPEGQuality   int
+	flagScopeFormat   string
+	flagTheme         string
+	flagPalette       string
+	flagMarkers       bool
+	flagCrop          string
+	flagScale         float64
+	flagScaler        string
+	flagVariants      variantsFlag
+	flagDrawings      drawingsFlag
+	flagDrawingsFile  string
+	flagTimeLapse     timeLapseT
+	flagTrigger       triggerT
+	flagWaveforms     bool
+
+	// console receives informational output. Subcommands print their results on stdout, so
+	// they send everything else to stderr.
+	console io.Writer = os.Stdout
+
+	// sessionID identifies all captures made by this run of the app
+	sessionID = newSessionID()
 
 	colorTimestamp = color.RGBA{0, 219, 146, 255} // LightGreen
-	colorLabels    = []color.Color{
-		color.RGBA{176, 176, 176, 255}, // Note: Gray
-		color.RGBA{247, 250, 82, 255},  // CH1: Yellow
-		color.RGBA{0, 225, 221, 255},   // CH2: Cyan
-		color.RGBA{221, 0, 221, 255},   // CH3: Magenta
-		color.RGBA{0, 127, 245, 255},   // CH4: Blue
-	}
 )
 
 func main() {
 	var err error
 
+	subcommandName, subcommand, isSubcommand := lookupSubcommand(os.Args[1:])
+	if isSubcommand {
+		console = os.Stderr
+	}
+
 	// ---------------------------
 	// Show Version
 	// ---------------------------
-	versionInfo := fmt.Sprintf("%s (%s), %s", config.AppName, config.AppTitle, moduleconfig.ModuleVersion)
-	fmt.Println(versionInfo)
+	fmt.Fprintln(console, versionInfo())
+
+	if isSubcommand {
+		runSubcommand(subcommandName, subcommand, os.Args[2:])
+	}
 
 	// ---------------------------
 	// Parse command line arguments
@@ -76,7 +108,12 @@ func main() {
 			config.ScopeHostname))
 	flag.IntVar(&flagScopePort, "port", 0,
 		fmt.Sprintf("Port number of the oscilloscope (Defaults to %d)", config.ScopePort))
-	flag.StringVar(&flagFilename, "file", "", "Optional name of output file")
+	flag.StringVar(&flagScope, "scope", "",
+		"Name of the scope profile (from the config file) to use (Defaults to the config file's default_scope)")
+	flag.StringVar(&flagScopes, "scopes", "",
+		"Capture from several scopes at once: a comma separated list of scope names from the config file, or HOST[:PORT] addresses")
+	flag.StringVar(&flagFilename, "file", "",
+		"Optional name of output file. May be a template such as \"{date}_{time}_{model}_{note}_{seq}.{ext}\"")
 	flag.StringVar(&flagNote, "note", "", "Note to add to the image")
 	flag.StringVar(&flagNote, "n", "", "Note to add to the image")
 	flag.StringVar(&flagLabel1, "label1", "", "Channel 1 label")
@@ -87,6 +124,64 @@ func main() {
 	flag.StringVar(&flagLabel3, "l3", "", "Channel 3 label")
 	flag.StringVar(&flagLabel4, "label4", "", "Channel 4 label")
 	flag.StringVar(&flagLabel4, "l4", "", "Channel 4 label")
+	flag.StringVar(&flagOutputDir, "outdir", "",
+		fmt.Sprintf("Output directory, which may be a template such as \"~/captures/{project}/{yyyy-mm-dd}\" (Defaults to $%s, then %q)",
+			envOutputDir, pathDirScopeCaptures))
+	flag.StringVar(&flagProject, "project", "", "Project name, used by the {project} template token")
+	flag.StringVar(&flagFormat, "format", "",
+		fmt.Sprintf("Output image format: %s (Defaults to the -file extension, then png)", formatNames()))
+	flag.IntVar(&flagJPEGQuality, "jpeg-quality", defaultJPEGQuality, "JPEG quality, 1-100")
+	flag.StringVar(&flagScopeFormat, "scope-format", "",
+		"Image format to request from the scope: png, bmp24, bmp8 or jpeg. BMP avoids firmware PNG checksum bugs (Defaults per model, then png)")
+	flag.StringVar(&flagTheme, "theme", "",
+		fmt.Sprintf("Color theme: %s. \"print\" recolors for a white background; \"invert\" uses the scope's inverted colors (Defaults to %q)",
+			themeNames(), defaultThemeName))
+	flag.StringVar(&flagPalette, "palette", "",
+		fmt.Sprintf("Annotation color palette: %s (Defaults to %q)", paletteNames(), defaultPaletteName))
+	flag.BoolVar(&flagMarkers, "markers", false,
+		"Draw a line style marker next to each label, so sources can be told apart without color")
+	flag.StringVar(&flagCrop, "crop", fullRegion,
+		fmt.Sprintf("Crop the annotated image to a region: %s", regionNames(layouts[defaultLayoutName])))
+	flag.Float64Var(&flagScale, "scale", 1, "Scale the annotated image by this factor (e.g. 2, or 0.5)")
+	flag.StringVar(&flagScaler, "scaler", "auto",
+		"Scaling method: nearest, smooth, or auto (nearest for whole number scales, otherwise smooth)")
+	flag.Var(&flagVariants, "variant",
+		"Also write a variant of the annotated image as SUFFIX=REGION[@SCALE] (e.g. thumb=full@0.25 writes NAME@thumb.png). May be repeated.")
+	flag.Var(&flagDrawings, "draw",
+		"Draw an arrow, rect, circle or text callout, e.g. \"arrow 1.2ms,2.5V 300,100 Glitch\" or \"circle 2div,-1div 15 Here\". May be repeated.")
+	flag.StringVar(&flagDrawingsFile, "drawings", "", "JSON or YAML file of drawings to add, as {\"drawings\": [...]}")
+	flag.BoolVar(&flagEmbedSetup, "embed-setup", false,
+		"Embed the scope's setup in each capture's metadata, so that `setup load CAPTURE` can restore it")
+	flag.StringVar(&flagRecipe, "recipe", "",
+		"JSON or YAML recipe of scope settings and measurements to apply (and verify) before capturing")
+	flag.StringVar(&flagMeasure, "measure", "",
+		"Record these measurements with each capture, e.g. \"VPP CH1,FREQ CH1\" (Defaults to the config file's measurements)")
+	flag.BoolVar(&flagKeepRaw, "keep-raw", false,
+		"Keep each raw (unannotated) capture alongside its annotated version")
+	flag.DurationVar(&flagTimeLapse.Interval, "interval", 0,
+		"Time-lapse: capture repeatedly, this often (e.g. 5s). Use with -count and/or -duration")
+	flag.IntVar(&flagTimeLapse.Count, "count", 0, "Time-lapse: number of captures to take")
+	flag.DurationVar(&flagTimeLapse.Duration, "duration", 0, "Time-lapse: keep capturing for this long (e.g. 10m)")
+	flag.IntVar(&flagTimeLapse.Retries, "retries", 3, "Time-lapse: attempts to make at each capture before skipping it")
+	flag.StringVar(&flagTimeLapse.Animate, "animate", "",
+		"Time-lapse: also assemble the captures into this animated GIF (.gif) or APNG (.png)")
+	flag.BoolVar(&flagTrigger.Single, "single", false,
+		"Arm the scope with a single trigger (:SING), wait for it to trigger, then capture")
+	flag.BoolVar(&flagTrigger.Wait, "wait-trigger", false,
+		"Wait for the (already armed) scope to trigger, then capture")
+	flag.DurationVar(&flagTrigger.Timeout, "trigger-timeout", 0,
+		"Give up waiting for a trigger after this long (e.g. 30s). With -loop, re-arm instead")
+	flag.BoolVar(&flagTrigger.Loop, "loop", false,
+		"Capture every trigger event, re-arming after each one. Use -count and/or -duration to limit")
+	flag.BoolVar(&flagWaveforms, "waveforms", false,
+		"Also save the displayed channels' waveforms as CSV (always done for trigger-armed captures)")
+	flag.Var(&flagLabels, "label",
+		"Source label as SOURCE=TEXT (e.g. CH1=Clock, MATH=Sum, REF1=Golden, D0-D7=SPI bus). May be repeated.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printSubcommandUsage()
+	}
 
 	flag.Parse()
 
@@ -95,6 +190,155 @@ func main() {
 		os.Exit(0)
 	}
 
+	err = startup()
+	if err != nil {
+		log.ErrorPrintf("Failed to load config file: %v", err)
+		os.Exit(1)
+	}
+	// Now that configuration has been loaded, we can set the ip and port, and then apply the
+	// command line overrides, if any.
+	scopeHostname := config.ScopeHostname
+	scopePort := config.ScopePort
+	if flagScopeHostname != "" {
+		scopeHostname = flagScopeHostname
+		log.InfoPrintf("Adopting scope hostname fom command line: %q", scopeHostname)
+	}
+	if flagScopePort != 0 {
+		scopePort = flagScopePort
+		log.InfoPrintf("Adopting scope port from command line: %d", scopePort)
+	}
+
+	if flagProject != "" {
+		config.Project = flagProject
+		log.InfoPrintf("Adopting project from command line: %q", config.Project)
+	}
+	if flagEmbedSetup {
+		config.EmbedSetup = true
+	}
+	if flagKeepRaw {
+		config.KeepRaw = true
+	}
+	if flagTheme != "" {
+		config.Theme = flagTheme
+	}
+	if _, err := lookupTheme(config.Theme); err != nil {
+		log.ErrorPrintf("%v", err)
+		os.Exit(1)
+	}
+	if flagPalette != "" {
+		config.Palette = flagPalette
+	}
+	if err := checkPalette(config.Palette); err != nil {
+		log.ErrorPrintf("%v", err)
+		os.Exit(1)
+	}
+	if flagMarkers {
+		config.Markers = true
+	}
+	if flagMeasure != "" {
+		if config.Measurements, err = parseMeasurements(flagMeasure); err != nil {
+			log.ErrorPrintf("%v", err)
+			os.Exit(1)
+		}
+	}
+	view := viewT{Region: strings.ToLower(flagCrop), Scale: flagScale, Scaler: strings.ToLower(flagScaler)}
+	if err := checkView(view); err != nil {
+		log.ErrorPrintf("%v", err)
+		os.Exit(1)
+	}
+	for i := range flagVariants {
+		flagVariants[i].View.Scaler = view.Scaler
+	}
+	drawings := []drawingT(flagDrawings)
+	if flagDrawingsFile != "" {
+		fileDrawings, err := loadDrawings(flagDrawingsFile)
+		if err != nil {
+			log.ErrorPrintf("%v", err)
+			os.Exit(1)
+		}
+		drawings = append(fileDrawings, drawings...)
+	}
+
+	fileType, err := selectFormat(flagFormat, filenameTemplate(flagFilename, flagNote))
+	if err != nil {
+		log.ErrorPrintf("%v", err)
+		os.Exit(1)
+	}
+	if flagScopeFormat != "" {
+		if _, err := selectScopeFormat(flagScopeFormat, ""); err != nil {
+			log.ErrorPrintf("%v", err)
+			os.Exit(1)
+		}
+	}
+	if flagJPEGQuality < 1 || flagJPEGQuality > 100 {
+		log.ErrorPrintf("-jpeg-quality must be between 1 and 100")
+		os.Exit(1)
+	}
+	var recipe *recipeT
+	if flagRecipe != "" {
+		if recipe, err = loadRecipe(flagRecipe); err != nil {
+			log.ErrorPrintf("%v", err)
+			os.Exit(1)
+		}
+	}
+	// The selected scope's labels are the defaults, except with -scopes, where each scope has
+	// its own
+	channelLabels := []string{flagLabel1, flagLabel2, flagLabel3, flagLabel4}
+	labels := replaceLabels(config.Labels, channelLabels, flagLabels)
+	if flagScopes != "" {
+		labels = mergeLabels(channelLabels, flagLabels)
+	}
+	options := captureOptionsT{
+		Scope:        config.Scope,
+		Recipe:       recipe,
+		Measurements: recipe.withMeasurements(config.Measurements),
+		OutputDir:    outputDirTemplate(flagOutputDir),
+		Filename:     flagFilename,
+		FileType:     fileType,
+		ScopeFormat:  flagScopeFormat,
+		Theme:        config.Theme,
+		View:         view,
+		Variants:     flagVariants,
+		Drawings:     drawings,
+		Encode:       encodeOptionsT{JPEGQuality: flagJPEGQuality},
+		Note:         flagNote,
+		Labels:       labels,
+		Waveforms:    flagWaveforms || flagTrigger.enabled(),
+	}
+	if flagScopes != "" {
+		if flagScopeHostname != "" || flagScopePort != 0 || flagScope != "" {
+			log.ErrorPrintf("-scopes can't be combined with -scope, -host or -port")
+			os.Exit(1)
+		}
+		var scopes []namedScopeT
+		if scopes, err = lookupScopes(flagScopes); err != nil {
+			log.ErrorPrintf("%v", err)
+			os.Exit(1)
+		}
+		if flagOutputDir != "" || os.Getenv(envOutputDir) != "" {
+			// The command line and environment win over the scopes' own output directories
+			for i := range scopes {
+				scopes[i].OutputDir = ""
+			}
+		}
+		err = runMultiScope(scopes, options, flagTimeLapse, flagTrigger)
+	} else {
+		err = run(scopeHostname, scopePort, options, flagTimeLapse, flagTrigger)
+	}
+	if err != nil {
+		log.ErrorPrintf("%v", err)
+		os.Exit(1)
+	}
+}
+
+func versionInfo() string {
+	return fmt.Sprintf("%s (%s), %s", config.AppName, config.AppTitle, moduleconfig.ModuleVersion)
+}
+
+// startup starts the logger, loads the config file and selects the scope profile (if any, and
+// unless -scopes was given, since each of its scopes has its own). It must be called after the
+// command line has been parsed.
+func startup() error {
 	// ------------------------
 	// Start logger
 	// ------------------------
@@ -109,9 +353,10 @@ func main() {
 		Level:      logLevel,
 		MaxSize:    5,
 		MaxBackups: 3,
+		Console:    console,
 	}
 	log = quicklog.ConfigureLogger(loggingConfig)
-	log.Info(versionInfo)
+	log.Info(versionInfo())
 
 	// This will only show up in the log if we enabled debug logging above
 	log.Debug("Debug logging enabled.")
@@ -119,76 +364,171 @@ func main() {
 	// ---------------------------
 	// Load and parse config file
 	// ---------------------------
-	err = loadAndParseConfigFile()
-	if err != nil {
-		log.ErrorPrintf("Failed to load config file: %v", err)
-		os.Exit(1)
-	}
-	// Now that configuration has been loaded, we can set the ip and port, and then apply the
-	// command line overrides, if any.
-	scopeHostname := config.ScopeHostname
-	scopePort := config.ScopePort
-	if flagScopeHostname != "" {
-		scopeHostname = flagScopeHostname
-		log.InfoPrintf("Adopting scope hostname fom command line: %q", scopeHostname)
+	if err := loadAndParseConfigFile(); err != nil {
+		return err
 	}
-	if flagScopePort != 0 {
-		scopePort = flagScopePort
-		log.InfoPrintf("Adopting scope port from command line: %d", scopePort)
+	if flagScopes != "" {
+		// Each scope's profile applies only to its own capture
+		return nil
 	}
+	return selectScope(flagScope)
+}
+
+// newSessionID returns an ID which is (for practical purposes) unique to this run of the app,
+// e.g. "20250116-192433-3f9a".
+func newSessionID() string {
+	random := make([]byte, 2)
+	rand.Read(random)
+	return fmt.Sprintf("%s-%x", time.Now().Format("20060102-150405"), random)
+}
 
-	err = run(
-		scopeHostname, scopePort, flagFilename, "png", flagNote,
-		[]string{flagLabel1, flagLabel2, flagLabel3, flagLabel4})
+// captureOptionsT holds everything which controls how a capture is named and annotated.
+type captureOptionsT struct {
+	// OutputDir and Filename may be templates
+	OutputDir string
+	Filename  string
+	// FileType is the output format name (a key of imageFormats)
+	FileType string
+	Encode   encodeOptionsT
+	// ScopeFormat is the image format to request from the scope ("" for the model's default)
+	ScopeFormat string
+	// Theme is the color theme name ("" for the default)
+	Theme string
+	// View crops and scales the annotated image, and Variants are additional images derived
+	// from it
+	View     viewT
+	Variants []variantT
+	// Drawings are drawn over the annotated image
+	Drawings []drawingT
+	Note     string
+	Labels   []labelT
+	// FirstSeq is the first value tried for the {seq} filename token
+	FirstSeq int
+	// Waveforms saves the displayed waveforms as CSV alongside the image
+	Waveforms bool
+	// Recipe (optional) is applied to the scope before capturing
+	Recipe *recipeT
+	// Measurements are read from the scope and recorded with each capture, e.g. "VPP CH1"
+	Measurements []string
+	// Settings (if set) are recorded instead of reading them from the scope, e.g. once for a
+	// whole time-lapse
+	Settings map[string]string
+	// Procedure is the procedure file (if any) making the capture
+	Procedure string
+	// Scope is the scope's name, when capturing from several, and Layout its screen layout ("" for
+	// the selected scope's)
+	Scope  string
+	Layout string
+}
+
+func run(scopeHostname string, scopePort int, options captureOptionsT, timeLapse timeLapseT, trigger triggerT) error {
+	session, err := openSession(scopeHostname, scopePort)
 	if err != nil {
-		log.ErrorPrintf("%v", err)
-		os.Exit(1)
+		return err
+	}
+	defer session.Close()
+
+	if options.Recipe != nil {
+		if _, err := options.Recipe.apply(session.Conn); err != nil {
+			return err
+		}
+	}
+	if trigger.enabled() {
+		return runTriggered(session, options, trigger, timeLapse)
+	}
+	if timeLapse.enabled() {
+		return runTimeLapse(session, options, timeLapse)
 	}
+	_, err = captureOnce(session, options)
+	return err
 }
 
-func run(
-	scopeHostname string,
-	scopePort int,
-	filename,
-	fileType string,
-	note string,
-	labels []string) error {
-	if err := testPing(scopeHostname); err != nil {
-		return err
+// captureOnce captures, annotates and saves the screen of an open session's scope and adds it
+// to the index.
+func captureOnce(session *sessionT, options captureOptionsT) (captureRecordT, error) {
+	record := captureRecordT{
+		Time:       time.Now(),
+		Session:    sessionID,
+		Host:       config.Hostname,
+		Project:    config.Project,
+		Instrument: session.Instrument,
+		Scope:      options.Scope,
+		Note:       options.Note,
+		Labels:     options.Labels,
+		Theme:      options.Theme,
+		Drawings:   options.Drawings,
+		Procedure:  options.Procedure,
+	}
+	if options.Recipe != nil {
+		record.Recipe = options.Recipe.Name
+	}
+	var err error
+	record.Settings = options.Settings
+	if record.Settings == nil {
+		if record.Settings, err = querySettings(session.Conn); err != nil {
+			return record, err
+		}
+	}
+	if record.Measurements, err = queryMeasurements(session.Conn, options.Measurements); err != nil {
+		return record, err
+	}
+	if config.EmbedSetup {
+		if record.Setup, err = queryTMCBlock(session.Conn, ":SYST:SET?"); err != nil {
+			return record, fmt.Errorf("failed to read the scope setup: %v", err)
+		}
 	}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", scopeHostname, scopePort))
+	ctx := templateContextT{
+		Time:       record.Time,
+		Instrument: record.Instrument,
+		Note:       options.Note,
+		Project:    config.Project,
+		Labels:     options.Labels,
+		Ext:        imageFormats[options.FileType].Ext,
+		Scope:      options.Scope,
+		Query:      session.command,
+	}
+	filename, err := expandTemplate(filenameTemplate(options.Filename, options.Note), ctx)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", scopeHostname, err)
+		return record, fmt.Errorf("failed to build output filename: %w", err)
 	}
-	defer conn.Close()
-
-	instrumentID, err := command(conn, "*IDN?")
+	indexDir, err := indexDirForOutputDir(options.OutputDir)
 	if err != nil {
-		return err
+		return record, err
+	}
+	outputDir, err := resolveOutputDir(options.OutputDir, ctx)
+	if err != nil {
+		return record, err
 	}
-	log.InfoPrintf("Instrument ID: %q.", instrumentID)
 
-	if filename == "" && note != "" {
-		// Set filename to note, converted to filename-safe characters
-		filename = makeFilenameSafe(note) + ".png"
+	if _, ok := imageFormats[options.FileType]; !ok {
+		return record, fmt.Errorf("unsupported file type %q", options.FileType)
 	}
-	if filename == "" {
-		id := strings.ReplaceAll(instrumentID, ",", "_")
-		id = strings.ReplaceAll(id, " ", "_")
-		filename = fmt.Sprintf(
-			"%s_%s.png", id, time.Now().Format("2006-01-02_15-04-05"))
+	// Read the waveforms before the screen, so that a failure doesn't leave an orphaned image
+	var waveforms []waveformT
+	if options.Waveforms {
+		waveforms, err = readWaveforms(session.Conn, displayedChannels(record.Settings))
+		if err != nil {
+			return record, err
+		}
 	}
 
-	if fileType == "png" {
-		return captureScreen(conn, filename, note, labels)
+	record.Path = filepath.Join(outputDir, filename)
+	if err := captureScreen(session.Conn, &record, options); err != nil {
+		return record, err
 	}
-
-	return errors.New("unsupported file type")
+	if len(waveforms) > 0 {
+		path, err := writeWaveforms(record.Path, waveforms)
+		if err != nil {
+			return record, err
+		}
+		record.Waveforms = filepath.Base(path)
+	}
+	return record, appendToIndex(indexDir, record)
 }
 
-func testPing(hostname string) error {
-	ip := fmt.Sprintf("%s:%d", hostname, config.ScopePort)
+func testPing(hostname string, port int) error {
+	ip := net.JoinHostPort(hostname, strconv.Itoa(port))
 	log.InfoPrintf("Pinging scope at %q...", ip)
 	conn, err := net.DialTimeout("tcp", ip, pingTimeout)
 	if err != nil {
@@ -237,9 +577,9 @@ func commandRaw(conn net.Conn, scpi string) ([]byte, error) {
 	}
 
 	// log.Infof("Received SCPI response of %d bytes: %q", len(response), response)
-	log.Infof("Received SCPI response of %d bytes: %q", n, string(data))
+	log.Infof("Received SCPI response of %d bytes: %q", n, string(data[:n]))
 	// return response, nil
-	return data, nil
+	return data[:n], nil
 }
 
 func command(conn net.Conn, scpi string) (string, error) {
@@ -261,28 +601,42 @@ func command(conn net.Conn, scpi string) (string, error) {
 	return response, nil
 }
 
-func captureScreen(conn net.Conn, filename string, note string, labels []string) error {
-	log.InfoPrint("Capturing scope screen...")
-	// Send the SCPI command to capture the screen
-	buff, err := commandRaw(conn, ":DISP:DATA? ON,OFF,PNG")
-	if err != nil {
+// send sends a SCPI command which has no response.
+func send(conn net.Conn, scpi string) error {
+	log.Infof("SCPI to be sent: %s", scpi)
+	if err := waitForReady(conn); err != nil {
 		return err
 	}
+	if _, err := fmt.Fprintf(conn, "%s\n", scpi); err != nil {
+		return fmt.Errorf("failed to send SCPI command: %v", err)
+	}
+	return nil
+}
+
+// queryTMCBlock sends a SCPI query whose response is a TMC block (e.g. "#9000001200<data>")
+// and returns the block's data.
+func queryTMCBlock(conn net.Conn, scpi string) ([]byte, error) {
+	buff, err := commandRaw(conn, scpi)
+	if err != nil {
+		return nil, err
+	}
 
-	expectedBuffLengthBytes := expectedBuffBytes(buff)
+	expectedBuffLengthBytes, err := expectedBuffBytes(buff)
+	if err != nil {
+		return nil, err
+	}
 	log.Infof("expectedBuffLengthBytes: %d", expectedBuffLengthBytes)
 
 	// Prepare buffer to hold the full response
 	data := make([]byte, expectedBuffLengthBytes)
-	copy(data, buff)
+	bytesRead := copy(data, buff)
 
 	// Continue reading until the full expected buffer is received
-	bytesRead := len(buff)
 	for bytesRead < expectedBuffLengthBytes {
 		// Set a read deadline to avoid blocking forever
 		err := conn.SetReadDeadline(time.Now().Add(receiveTimeout))
 		if err != nil {
-			return fmt.Errorf("failed to set read deadline: %v", err)
+			return nil, fmt.Errorf("failed to set read deadline: %v", err)
 		}
 
 		// Read the remaining data directly into the buffer
@@ -310,114 +664,233 @@ func captureScreen(conn net.Conn, filename string, note string, labels []string)
 			n, bytesRead, expectedBuffLengthBytes, expectedBuffLengthBytes-bytesRead)
 	}
 
-	// // Verify if we got the full response
-	// if bytesRead < expectedBuffLengthBytes {
-	// 	log.Infof("Incomplete data: got %d out of %d bytes", bytesRead, expectedBuffLengthBytes)
-	// 	return errors.New("failed to read all expected buffer data")
-	// }
-
-	// // Save the `data` to a file for debugging
-	// outFile, err := os.Create("raw_screenshot.DEBUG.png")
-	// if err != nil {
-	// 	return fmt.Errorf("failed to create output file: %v", err)
-	// }
-	// defer outFile.Close()
-	// outFile.Write(data)
+	if bytesRead < expectedBuffLengthBytes {
+		return nil, fmt.Errorf("incomplete response to %s: got %d of %d bytes", scpi, bytesRead, expectedBuffLengthBytes)
+	}
 
 	// Strip TMC Blockheader and keep only the data
-	tmcHeaderLen := tmcHeaderBytes(data)
-	expectedDataLen := expectedDataBytes(data)
-	if len(data) < tmcHeaderLen+expectedDataLen {
-		return errors.New("buffer is too short for expected data")
-	}
-	// data = data[tmcHeaderLen : tmcHeaderLen+expectedDataLen]
-	data = data[tmcHeaderLen : bytesRead-1]
+	tmcHeaderLen, _ := tmcHeaderBytes(data)
+	return data[tmcHeaderLen : bytesRead-1], nil
+}
 
-	// FIXME: This is a workaround for a Rigol scope that incorrectly is generating bad PNG checksums.
-	log.InfoPrint("Auto-correcting PNG checksum...")
-	data, err = FixPNGChecksum(data)
-	if err != nil {
-		return fmt.Errorf("failed to fix PNG checksum: %v", err)
+// sendTMCBlock sends a command followed by a TMC block of data (e.g. ":SYST:SET" and a setup),
+// and waits for the scope to finish processing it.
+func sendTMCBlock(conn net.Conn, scpi string, data []byte) error {
+	log.Infof("sendTMCBlock(): Sending %s with %d bytes of data", scpi, len(data))
+	if err := waitForReady(conn); err != nil {
+		return err
 	}
-	log.InfoPrint("    Checksum corrected.")
+	length := strconv.Itoa(len(data))
+	block := append([]byte(fmt.Sprintf("%s #%d%s", scpi, len(length), length)), data...)
+	if _, err := conn.Write(append(block, '\n')); err != nil {
+		return fmt.Errorf("failed to send SCPI command: %v", err)
+	}
+	return waitForReady(conn)
+}
 
-	// Save the raw (unannotated) scope capture to a file
-	outPath := pathDirScopeCaptures + "/raw_scope_capture.png"
-	if err := os.MkdirAll(pathDirScopeCaptures, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory %q: %v", pathDirScopeCaptures, err)
+// captureScreen captures, annotates and saves the scope screen. record.Path is the requested
+// output path, and is updated to the path actually written, along with record.SHA256. The
+// annotated image is written in the format given by options.FileType.
+func captureScreen(conn net.Conn, record *captureRecordT, options captureOptionsT) error {
+	theme, err := lookupTheme(options.Theme)
+	if err != nil {
+		return err
 	}
-	outFileDebug, err := os.Create(outPath)
+	img, data, err := captureImage(conn, options.ScopeFormat, record.Instrument.Model, theme.ScopeInvert)
 	if err != nil {
-		return fmt.Errorf("failed to create DEBUG output file: %v", err)
+		return err
 	}
-	defer outFileDebug.Close()
-	outFileDebug.Write(data)
-	log.InfoPrintf("Wrote raw scope capture to %q.", outPath)
+	layout := layoutForImage(img, options.Layout)
+	record.Layout = layout.Name
 
-	// Decode the PNG image from the buffer
-	img, _, err := image.Decode(bytes.NewReader(data))
+	// Reserve a unique name for the annotated image file
+	outPath, err := allocateOutputFile(record.Path, options.FirstSeq)
 	if err != nil {
-		return fmt.Errorf("failed to decode image: %v", err)
+		return err
 	}
+	success := false
+	defer func() {
+		if !success {
+			// Don't leave an empty placeholder behind
+			os.Remove(outPath)
+		}
+	}()
 
-	// Create and save the image file
-	outPath = pathDirScopeCaptures + "/" + filename
-	outPath = appendNumericSuffixOnFileExists(outPath)
-	outFile, err := os.Create(outPath)
+	// Save the raw (unannotated) scope capture to a file. Unless we are keeping every raw
+	// capture, a single debug file is overwritten each time. The raw capture is always a PNG.
+	rawPath := filepath.Join(filepath.Dir(outPath), "raw_scope_capture.png")
+	if config.KeepRaw {
+		rawPath = strings.TrimSuffix(outPath, filepath.Ext(outPath)) + ".raw.png"
+	}
+	rawData, err := embedPNGMetadata(data, *record)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return err
+	}
+	if err := writeFileAtomic(rawPath, rawData); err != nil {
+		return err
 	}
-	defer outFile.Close()
+	log.InfoPrintf("Wrote raw scope capture to %q.", rawPath)
 
 	log.InfoPrint("Annotating scope capture...")
-	imgWithLabels := addLabelsToImage(img, note, labels)
-	err = png.Encode(outFile, imgWithLabels)
+	imgWithLabels := addLabelsToImage(img, layout, record.Time, record.Note, record.Labels, theme, config.Markers)
+	if err := addDrawings(imgWithLabels, layout, record.Drawings, record.Settings, theme); err != nil {
+		return err
+	}
+	record.Variants = nil
+	for _, variant := range options.Variants {
+		record.Variants = append(record.Variants, filepath.Base(variantPath(outPath, variant.Suffix)))
+	}
+	outData, err := writeAnnotatedImage(outPath, options.View.apply(imgWithLabels, layout), *record, options)
 	if err != nil {
-		return fmt.Errorf("failed to encode PNG: %v", err)
+		return err
 	}
+	success = true
+	record.Path = outPath
+	record.SHA256 = sha256Hex(outData)
 	log.InfoPrintf("Wrote annotated scope capture to %q.", outPath)
 
+	for _, variant := range options.Variants {
+		path := variantPath(outPath, variant.Suffix)
+		if _, err := writeAnnotatedImage(path, variant.View.apply(imgWithLabels, layout), *record, options); err != nil {
+			return err
+		}
+		log.InfoPrintf("Wrote %s variant (%v) to %q.", variant.Suffix, variant.View, path)
+	}
+
 	return nil
 }
 
-func addLabelsToImage(img image.Image, note string, labels []string) image.Image {
+// captureImage captures the scope screen, in the scope format selected by format and model (see
+// selectScopeFormat), and returns it decoded and as (checksum corrected) PNG data.
+func captureImage(conn net.Conn, format, model string, invert bool) (image.Image, []byte, error) {
+	scopeFormat, err := selectScopeFormat(format, model)
+	if err != nil {
+		return nil, nil, err
+	}
+	invertParam := "OFF"
+	if invert {
+		invertParam = "ON"
+	}
+	log.InfoPrintf("Capturing scope screen (%s)...", scopeFormats[scopeFormat])
+	// Send the SCPI command to capture the screen
+	data, err := queryTMCBlock(conn, ":DISP:DATA? ON,"+invertParam+","+scopeFormats[scopeFormat])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if scopeFormat == "png" {
+		// FIXME: This is a workaround for a Rigol scope that incorrectly is generating bad PNG checksums.
+		log.InfoPrint("Auto-correcting PNG checksum...")
+		data, err = FixPNGChecksum(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fix PNG checksum: %v", err)
+		}
+		log.InfoPrint("    Checksum corrected.")
+	}
+
+	// Decode the image from the buffer
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	if scopeFormat != "png" {
+		// The raw capture is always saved as PNG
+		data, err = encodePNG(img, encodeOptionsT{})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return img, data, nil
+}
+
+// writeAnnotatedImage encodes img in the output format, with the capture metadata embedded or
+// in a sidecar file, writes it to path and returns the encoded image.
+func writeAnnotatedImage(path string, img image.Image, record captureRecordT, options captureOptionsT) ([]byte, error) {
+	format := imageFormats[options.FileType]
+	data, err := format.Encode(img, options.Encode)
+	if err != nil {
+		return nil, err
+	}
+	if format.EmbedsMetadata {
+		data, err = embedPNGMetadata(data, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, err
+	}
+	if !format.EmbedsMetadata {
+		if err := writeSidecar(path, record); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// addLabelsToImage annotates img, whose screen regions are given by layout, with the timestamp,
+// note and labels. If markers is set then each label is preceded by its source's line style.
+func addLabelsToImage(img image.Image, layout *layoutT, timestamp time.Time, note string, labels []labelT, theme *themeT, markers bool) *image.RGBA {
 	bounds := img.Bounds()
 	newImg := image.NewRGBA(bounds)
 	draw.Draw(newImg, bounds, img, bounds.Min, draw.Src)
-
-	// Define erasure rectangles (blackout areas)
-	eraseRects := []image.Rectangle{
-		image.Rect(3, 8, 80, 28),       // Logo
-		image.Rect(0, 37, 59, 450),     // Left menu
-		image.Rect(705, 38, 799, 436),  // Right menu items
-		image.Rect(690, 39, 704, 117),  // Right menu tab text
-		image.Rect(762, 456, 799, 479), // Lower right icon
+	if theme.Recolor != nil {
+		recolorImage(newImg, theme.Recolor)
 	}
 
-	// Fill erase areas with black
-	for _, rect := range eraseRects {
-		draw.Draw(newImg, rect, &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	// Fill erase areas (blackout areas) with the background color
+	for _, rect := range layout.EraseRects {
+		draw.Draw(newImg, rect, &image.Uniform{theme.Background}, image.Point{}, draw.Src)
 	}
 
 	// Draw timestamp
-	now := time.Now()
-	addLabel(newImg, now.Format("2006-01-02"), 2, 2, colorTimestamp)
-	addLabel(newImg, now.Format("15:04:05"), 2, 15, colorTimestamp)
+	origin := layout.TimestampOrigin
+	timestampColor := theme.Annotation(colorTimestamp)
+	addLabel(newImg, timestamp.Format("2006-01-02"), origin.X, origin.Y, timestampColor)
+	addLabel(newImg, timestamp.Format("15:04:05"), origin.X, origin.Y+13, timestampColor)
 
-	// Draw note and labels
+	// Draw note and labels, filling each label area from right to left
 	const labelSpacing = 14
-	locationY := 44
-	locationX := 800 - 10 - labelSpacing
-	allLabels := append([]string{note}, labels...)
-	for i, label := range allLabels {
-		if label != "" {
-			text := label
-			if i > 0 {
-				text = fmt.Sprintf("CH%d: %s", i, label)
+	texts := []string{}
+	colors := []color.Color{}
+	styles := [][]bool{}
+	if note != "" {
+		texts = append(texts, note)
+		colors = append(colors, theme.Annotation(colorNote))
+		styles = append(styles, nil)
+	}
+	for _, label := range labels {
+		texts = append(texts, label.String())
+		colors = append(colors, theme.Annotation(sourceColor(label.Source)))
+		if markers {
+			styles = append(styles, sourceMarker(label.Source))
+		} else {
+			styles = append(styles, nil)
+		}
+	}
+	firstColumnX := func(area image.Rectangle) int {
+		return area.Max.X - 10 - labelSpacing + 1
+	}
+	areaIndex := 0
+	locationX := 0
+	if len(layout.LabelAreas) > 0 {
+		locationX = firstColumnX(layout.LabelAreas[0])
+	}
+	for i, text := range texts {
+		if areaIndex < len(layout.LabelAreas) && locationX < layout.LabelAreas[areaIndex].Min.X {
+			// This area is full, so move on to the next one
+			areaIndex++
+			if areaIndex < len(layout.LabelAreas) {
+				locationX = firstColumnX(layout.LabelAreas[areaIndex])
 			}
-			addRotatedLabel(newImg, text, locationX, locationY, colorLabels[i])
-			locationX -= labelSpacing
 		}
+		if areaIndex >= len(layout.LabelAreas) {
+			log.InfoPrintf("WARNING: No room left for %d label(s) starting with %q.", len(texts)-i, text)
+			break
+		}
+		locationY := layout.LabelAreas[areaIndex].Min.Y + 6
+		addRotatedLabel(newImg, text, locationX, locationY, colors[i], styles[i])
+		locationX -= labelSpacing
 	}
 
 	return newImg
@@ -439,14 +912,27 @@ func addLabel(img *image.RGBA, label string, x, y int, col color.Color) {
 	}
 }
 
-func addRotatedLabel(img *image.RGBA, label string, x, y int, col color.Color) {
+// addRotatedLabel draws label rotated 90 degrees clockwise. If marker is not nil then it is
+// drawn (as a line style sample) before the text.
+func addRotatedLabel(img *image.RGBA, label string, x, y int, col color.Color, marker []bool) {
 	face := basicfont.Face7x13
 	labelImg := image.NewRGBA(image.Rect(0, 0, 200, 20))
+	textX := 0
+	if marker != nil {
+		const markerLength = 16
+		for i := 0; i < markerLength; i++ {
+			if marker[i%len(marker)] {
+				labelImg.Set(i, 8, col)
+				labelImg.Set(i, 9, col)
+			}
+		}
+		textX = markerLength + 4
+	}
 	d := &font.Drawer{
 		Dst:  labelImg,
 		Src:  image.NewUniform(col),
 		Face: face,
-		Dot:  fixed.P(0, 13),
+		Dot:  fixed.P(textX, 13),
 	}
 	// d.DrawString(label)
 	// Manually draw each character with additional spacing
@@ -471,27 +957,44 @@ func rotate90(img *image.RGBA) *image.RGBA {
 	return rotated
 }
 
-func tmcHeaderBytes(buff []byte) int {
-	return 2 + int(buff[1]-'0')
+// tmcHeaderBytes returns the length of a TMC block's header (e.g. 11 for "#9000001200").
+func tmcHeaderBytes(buff []byte) (int, error) {
+	if len(buff) < 2 || buff[0] != '#' || buff[1] < '1' || buff[1] > '9' {
+		return 0, fmt.Errorf("response %q is not a TMC block", buff[:min(len(buff), 11)])
+	}
+	headerBytes := 2 + int(buff[1]-'0')
+	if len(buff) < headerBytes {
+		return 0, fmt.Errorf("response %q has an incomplete TMC block header", buff)
+	}
+	return headerBytes, nil
 }
 
-func expectedDataBytes(buff []byte) int {
-	headerBytes := tmcHeaderBytes(buff)
+func expectedDataBytes(buff []byte) (int, error) {
+	headerBytes, err := tmcHeaderBytes(buff)
+	if err != nil {
+		return 0, err
+	}
 	expectedDataBytesStr := string(buff[2:headerBytes])
 	log.Infof("expectedDataBytesStr: %q", expectedDataBytesStr)
 	// convert string (decimal)	to int
 	expectedDataBytes, err := strconv.Atoi(expectedDataBytesStr)
-	// FIXME: Handle error here better
 	if err != nil {
-		log.Infof("Error converting string to int: %v", err)
-		panic(err)
+		return 0, fmt.Errorf("invalid TMC block length %q", expectedDataBytesStr)
 	}
-	return expectedDataBytes
+	return expectedDataBytes, nil
 }
 
-func expectedBuffBytes(buff []byte) int {
+func expectedBuffBytes(buff []byte) (int, error) {
+	headerBytes, err := tmcHeaderBytes(buff)
+	if err != nil {
+		return 0, err
+	}
+	dataBytes, err := expectedDataBytes(buff)
+	if err != nil {
+		return 0, err
+	}
 	// TODO: I think this last +1 is for the terminating newline.  Confirm.
-	return tmcHeaderBytes(buff) + expectedDataBytes(buff) + 1
+	return headerBytes + dataBytes + 1, nil
 }
 
 func waitForReady(conn net.Conn) error {
@@ -541,7 +1044,7 @@ func getComputerName() string {
 		panic(err)
 	}
 	computername := strings.Replace(hostname, ".local", "", 1)
-	fmt.Printf("hostname:%#v computername:%#v\n", hostname, computername)
+	fmt.Fprintf(console, "hostname:%#v computername:%#v\n", hostname, computername)
 	return computername
 }
 
@@ -561,21 +1064,6 @@ func makeFilenameSafe(input string) string {
 	return replacer.Replace(input)
 }
 
-func appendNumericSuffixOnFileExists(filename string) string {
-	if _, err := os.Stat(filename); err == nil {
-		// File exists
-		base := filename[:len(filename)-4]
-		ext := filename[len(filename)-4:]
-		for i := 2; ; i++ {
-			newFilename := fmt.Sprintf("%s_%d%s", base, i, ext)
-			if _, err := os.Stat(newFilename); err != nil {
-				return newFilename
-			}
-		}
-	}
-	return filename
-}
-
 // FixPNGChecksum takes a []byte PNG and corrects the chunk checksums.
 func FixPNGChecksum(pngData []byte) ([]byte, error) {
 	const pngHeaderSize = 8
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"scopecapture/pkg/quicklog"
+)
+
+func TestMain(m *testing.M) {
+	log = quicklog.ConfigureLogger(quicklog.ConfigT{Level: quicklog.LogLevelDisabled, Console: io.Discard})
+	os.Exit(m.Run())
+}
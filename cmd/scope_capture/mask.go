@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	colorMask      = color.RGBA{255, 255, 255, 255} // White
+	colorViolation = color.RGBA{255, 40, 40, 255}   // Red
+)
+
+// maskT is a pass/fail envelope for one source's waveform: at each of Times (s, ascending) its
+// samples must lie between Lower and Upper (V), which are interpolated between times (a
+// repeated time makes a step). A NaN limit is not checked. Samples outside the mask's time span
+// are not checked.
+type maskT struct {
+	Source string
+	Times  []float64
+	Lower  []float64
+	Upper  []float64
+}
+
+// violationT is a run of consecutive samples on the same side of a mask.
+type violationT struct {
+	Source     string
+	Above      bool
+	Start, End float64 // Times of the first and last samples (s)
+	Samples    int
+	// Worst is the sample furthest outside the mask, and Limit the mask at that sample
+	Worst, Limit float64
+}
+
+func (v violationT) String() string {
+	side := "below the lower"
+	if v.Above {
+		side = "above the upper"
+	}
+	return fmt.Sprintf("%s: %d sample(s) %s limit from %s to %s (worst %s, limit %s)", v.Source, v.Samples,
+		side, formatSI(v.Start, "s"), formatSI(v.End, "s"), formatSI(v.Worst, "V"), formatSI(v.Limit, "V"))
+}
+
+// limits returns the mask at time t, and whether t is within the mask's time span.
+func (m maskT) limits(t float64) (lower, upper float64, ok bool) {
+	n := len(m.Times)
+	if n == 0 || t < m.Times[0] || t > m.Times[n-1] {
+		return 0, 0, false
+	}
+	i := sort.SearchFloat64s(m.Times, t)
+	if m.Times[i] == t || i == 0 {
+		return m.Lower[i], m.Upper[i], true
+	}
+	fraction := (t - m.Times[i-1]) / (m.Times[i] - m.Times[i-1])
+	interpolate := func(limits []float64) float64 {
+		return limits[i-1] + fraction*(limits[i]-limits[i-1])
+	}
+	return interpolate(m.Lower), interpolate(m.Upper), true
+}
+
+// test checks a waveform against the mask and returns the violations, in time order.
+func (m maskT) test(waveform waveformT) []violationT {
+	violations := []violationT{}
+	var current *violationT
+	for i, v := range waveform.Volts {
+		t := waveform.XOrigin + float64(i)*waveform.XIncrement
+		lower, upper, ok := m.limits(t)
+		above, below := ok && v > upper, ok && v < lower
+		if !above && !below {
+			current = nil
+			continue
+		}
+		limit := lower
+		if above {
+			limit = upper
+		}
+		if current == nil || current.Above != above {
+			violations = append(violations, violationT{Source: m.Source, Above: above, Start: t, Worst: v, Limit: limit})
+			current = &violations[len(violations)-1]
+		}
+		current.End = t
+		current.Samples++
+		if math.Abs(v-limit) > math.Abs(current.Worst-current.Limit) {
+			current.Worst, current.Limit = v, limit
+		}
+	}
+	return violations
+}
+
+// maskColumn matches a mask CSV column heading, e.g. "CH1_upper_V".
+func maskColumn(heading string) (source string, upper bool, ok bool) {
+	heading = strings.TrimSpace(heading)
+	for _, suffix := range []string{"_lower_V", "_upper_V"} {
+		if name, found := strings.CutSuffix(heading, suffix); found {
+			source, err := canonicalSource(name)
+			if err != nil || !strings.HasPrefix(source, "CH") {
+				return "", false, false
+			}
+			return source, suffix == "_upper_V", true
+		}
+	}
+	return "", false, false
+}
+
+// readMasks reads a mask CSV: a time_s column, followed by CHn_lower_V and/or CHn_upper_V
+// columns. An empty cell is not checked.
+func readMasks(path string) ([]maskT, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 || strings.TrimSpace(rows[0][0]) != "time_s" {
+		return nil, fmt.Errorf("%q is not a mask (expected a time_s column followed by CHn_lower_V/CHn_upper_V columns)", path)
+	}
+	masks := []maskT{}
+	bySource := map[string]int{}
+	for _, heading := range rows[0][1:] {
+		source, _, ok := maskColumn(heading)
+		if !ok {
+			return nil, fmt.Errorf("unexpected mask column %q in %q", heading, path)
+		}
+		if _, ok := bySource[source]; !ok {
+			bySource[source] = len(masks)
+			masks = append(masks, maskT{Source: source})
+		}
+	}
+	if len(masks) == 0 {
+		return nil, fmt.Errorf("%q has no CHn_lower_V or CHn_upper_V columns", path)
+	}
+	for r, row := range rows[1:] {
+		t, err := strconv.ParseFloat(strings.TrimSpace(row[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q at %s:%d", row[0], path, r+2)
+		}
+		if r > 0 && t < masks[0].Times[r-1] {
+			return nil, fmt.Errorf("times must not decrease, at %s:%d", path, r+2)
+		}
+		for m := range masks {
+			masks[m].Times = append(masks[m].Times, t)
+			masks[m].Lower = append(masks[m].Lower, math.NaN())
+			masks[m].Upper = append(masks[m].Upper, math.NaN())
+		}
+		for c, cell := range row[1:] {
+			if strings.TrimSpace(cell) == "" {
+				continue
+			}
+			limit, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit %q at %s:%d", cell, path, r+2)
+			}
+			source, upper, _ := maskColumn(rows[0][c+1])
+			mask := &masks[bySource[source]]
+			if upper {
+				mask.Upper[r] = limit
+			} else {
+				mask.Lower[r] = limit
+			}
+		}
+	}
+	return masks, nil
+}
+
+// readWaveformCSV reads waveforms saved with -waveforms (see waveformCSV).
+func readWaveformCSV(path string) ([]waveformT, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 3 || strings.TrimSpace(rows[0][0]) != "time_s" {
+		return nil, fmt.Errorf("%q is not a waveform CSV (expected a time_s column followed by CHn_V columns)", path)
+	}
+	times := make([]float64, len(rows)-1)
+	for r, row := range rows[1:] {
+		if times[r], err = strconv.ParseFloat(strings.TrimSpace(row[0]), 64); err != nil {
+			return nil, fmt.Errorf("invalid time %q at %s:%d", row[0], path, r+2)
+		}
+	}
+	waveforms := []waveformT{}
+	for c, heading := range rows[0][1:] {
+		source, err := canonicalSource(strings.TrimSuffix(strings.TrimSpace(heading), "_V"))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected waveform column %q in %q", heading, path)
+		}
+		// The times are rounded in the CSV, so use the average increment
+		waveform := waveformT{Source: source, XOrigin: times[0],
+			XIncrement: (times[len(times)-1] - times[0]) / float64(len(times)-1)}
+		for _, row := range rows[1:] {
+			cell := strings.TrimSpace(row[c+1])
+			if cell == "" {
+				break
+			}
+			v, err := strconv.ParseFloat(cell, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid voltage %q in %q", cell, path)
+			}
+			waveform.Volts = append(waveform.Volts, v)
+		}
+		waveforms = append(waveforms, waveform)
+	}
+	return waveforms, nil
+}
+
+// readCSV reads a CSV file in which every row has the same number of fields.
+func readCSV(path string) ([][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	return rows, nil
+}
+
+// deriveMask makes a mask from a golden waveform: at each sample the limits are tolerance (V)
+// beyond the lowest and highest samples within timeTolerance (s), so that edges may move by up
+// to timeTolerance.
+func deriveMask(golden waveformT, tolerance, timeTolerance float64) maskT {
+	mask := maskT{Source: golden.Source}
+	window := 0
+	if golden.XIncrement > 0 {
+		window = int(timeTolerance / golden.XIncrement)
+	}
+	for i := range golden.Volts {
+		lowest, highest := math.Inf(1), math.Inf(-1)
+		for j := max(i-window, 0); j <= min(i+window, len(golden.Volts)-1); j++ {
+			lowest, highest = min(lowest, golden.Volts[j]), max(highest, golden.Volts[j])
+		}
+		mask.Times = append(mask.Times, golden.XOrigin+float64(i)*golden.XIncrement)
+		mask.Lower = append(mask.Lower, lowest-tolerance)
+		mask.Upper = append(mask.Upper, highest+tolerance)
+	}
+	return mask
+}
+
+// maskCSV formats masks (which must share their times) as a mask CSV (see readMasks).
+func maskCSV(masks []maskT) []byte {
+	var b bytes.Buffer
+	b.WriteString("time_s")
+	for _, mask := range masks {
+		fmt.Fprintf(&b, ",%s_lower_V,%s_upper_V", mask.Source, mask.Source)
+	}
+	b.WriteString("\n")
+	formatLimit := func(limit float64) string {
+		if math.IsNaN(limit) {
+			return ""
+		}
+		return strconv.FormatFloat(limit, 'g', 6, 64)
+	}
+	for i, t := range masks[0].Times {
+		b.WriteString(strconv.FormatFloat(t, 'g', 9, 64))
+		for _, mask := range masks {
+			b.WriteString("," + formatLimit(mask.Lower[i]) + "," + formatLimit(mask.Upper[i]))
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// addMasks draws the masks' limits on an annotated capture, and marks the start and end of each
+// violation.
+func addMasks(img *image.RGBA, layout *layoutT, masks []maskT, violations []violationT, settings map[string]string, theme *themeT) error {
+	g := newGraticule(layout, settings)
+	graticule := layout.Regions["graticule"]
+	// Limits beyond the screen are clipped to the graticule
+	clipped := img.SubImage(graticule).(*image.RGBA)
+	for _, mask := range masks {
+		for _, limits := range [][]float64{mask.Lower, mask.Upper} {
+			var previous *image.Point
+			for i, t := range mask.Times {
+				if math.IsNaN(limits[i]) {
+					previous = nil
+					continue
+				}
+				x, err := g.timeX(t)
+				if err != nil {
+					return err
+				}
+				y, err := g.voltsY(limits[i], mask.Source)
+				if err != nil {
+					return err
+				}
+				p := image.Pt(int(math.Round(x)), int(math.Round(y)))
+				if previous != nil && *previous != p {
+					drawLine(clipped, *previous, p, theme.Annotation(colorMask))
+				}
+				previous = &p
+			}
+		}
+	}
+	for _, violation := range violations {
+		for _, t := range []float64{violation.Start, violation.End} {
+			x, err := g.timeX(t)
+			if err != nil {
+				return err
+			}
+			column := int(math.Round(x))
+			drawLine(clipped, image.Pt(column, graticule.Min.Y), image.Pt(column, graticule.Max.Y-2),
+				theme.Annotation(colorViolation))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMaskLimits(t *testing.T) {
+	nan := math.NaN()
+	mask := maskT{
+		Source: "CH1",
+		Times:  []float64{0, 1, 1, 3},
+		Lower:  []float64{0, 2, 4, 4},
+		Upper:  []float64{1, 3, 5, nan},
+	}
+	tests := []struct {
+		t            float64
+		lower, upper float64
+		ok           bool
+	}{
+		{-0.5, 0, 0, false},
+		{0, 0, 1, true},
+		{0.5, 1, 2, true},
+		// A repeated time makes a step, which takes the earlier limits at the step itself
+		{1, 2, 3, true},
+		{2, 4, nan, true},
+		{3, 4, nan, true},
+		{3.5, 0, 0, false},
+	}
+	same := func(a, b float64) bool { return a == b || math.IsNaN(a) && math.IsNaN(b) }
+	for _, test := range tests {
+		lower, upper, ok := mask.limits(test.t)
+		if ok != test.ok || !same(lower, test.lower) || !same(upper, test.upper) {
+			t.Errorf("limits(%v) = %v, %v, %v; want %v, %v, %v",
+				test.t, lower, upper, ok, test.lower, test.upper, test.ok)
+		}
+	}
+}
+
+func TestMaskTest(t *testing.T) {
+	mask := maskT{
+		Source: "CH1",
+		Times:  []float64{0, 10},
+		Lower:  []float64{0, 0},
+		Upper:  []float64{1, 1},
+	}
+	// Samples at -2s, -1s, 0s... Those outside the mask's time span aren't checked.
+	waveform := waveformT{Source: "CH1", XOrigin: -2, XIncrement: 1,
+		Volts: []float64{5, 5, 0.5, 1.5, 2, 1.2, -1, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 5}}
+	want := []violationT{
+		{Source: "CH1", Above: true, Start: 1, End: 3, Samples: 3, Worst: 2, Limit: 1},
+		{Source: "CH1", Above: false, Start: 4, End: 4, Samples: 1, Worst: -1, Limit: 0},
+	}
+	if got := mask.test(waveform); !reflect.DeepEqual(got, want) {
+		t.Errorf("test() = %+v; want %+v", got, want)
+	}
+}
+
+func TestReadMasks(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name string
+		csv  string
+		want []maskT
+		ok   bool
+	}{
+		{"both", "time_s,CH1_lower_V,CH1_upper_V,chan2_upper_V\n0,0,1,\n1e-3,0.5,,3.3\n", []maskT{
+			{Source: "CH1", Times: []float64{0, 1e-3}, Lower: []float64{0, 0.5}, Upper: []float64{1, nan}},
+			{Source: "CH2", Times: []float64{0, 1e-3}, Lower: []float64{nan, nan}, Upper: []float64{nan, 3.3}},
+		}, true},
+		{"step", "time_s,CH1_upper_V\n0,1\n1,1\n1,2\n", []maskT{
+			{Source: "CH1", Times: []float64{0, 1, 1}, Lower: []float64{nan, nan, nan}, Upper: []float64{1, 1, 2}},
+		}, true},
+		{"no header", "0,1\n1,2\n", nil, false},
+		{"no rows", "time_s,CH1_upper_V\n", nil, false},
+		{"no columns", "time_s\n0\n", nil, false},
+		{"unknown column", "time_s,CH1_V\n0,1\n", nil, false},
+		{"digital column", "time_s,D0_upper_V\n0,1\n", nil, false},
+		{"bad time", "time_s,CH1_upper_V\nzero,1\n", nil, false},
+		{"bad limit", "time_s,CH1_upper_V\n0,one\n", nil, false},
+		{"decreasing time", "time_s,CH1_upper_V\n1,1\n0,1\n", nil, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "mask.csv")
+		if err := os.WriteFile(path, []byte(test.csv), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readMasks(path)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: readMasks() error = %v; want ok %v", test.name, err, test.ok)
+			continue
+		}
+		// NaN limits aren't equal to themselves, so compare them as strings
+		if test.ok && fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: readMasks() = %v; want %v", test.name, got, test.want)
+		}
+	}
+}
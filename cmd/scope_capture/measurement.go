@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// measurementT is a measurement recorded with a capture.
+type measurementT struct {
+	// Name is the item and source, e.g. "VPP CH1"
+	Name string `json:"name"`
+	// Value is nil if the scope couldn't make the measurement
+	Value *float64 `json:"value,omitempty"`
+}
+
+// measurementUnits maps measurement items (or their prefixes) to their units.
+var measurementUnits = []struct {
+	prefix string
+	unit   string
+}{
+	{"FREQ", "Hz"},
+	{"PER", "s"}, {"RTIM", "s"}, {"FTIM", "s"}, {"PWID", "s"}, {"NWID", "s"}, {"RDEL", "s"},
+	{"FDEL", "s"}, {"TVM", "s"},
+	{"PDUT", "%"}, {"NDUT", "%"}, {"OVER", "%"}, {"PRES", "%"},
+	{"RPH", "°"}, {"FPH", "°"},
+	{"PSLEW", "V/s"}, {"NSLEW", "V/s"},
+	{"MAR", "Vs"}, {"MPAR", "Vs"},
+	{"VAR", "V²"},
+	{"PPUL", ""}, {"NPUL", ""}, {"PEDG", ""}, {"NEDG", ""},
+	{"V", "V"}, {"PVRMS", "V"},
+}
+
+// String formats a measurement for display, e.g. "VPP CH1 = 2.96V".
+func (m measurementT) String() string {
+	return m.Name + " = " + m.formatValue()
+}
+
+// formatValue formats a measurement's value with its unit, e.g. "2.96V".
+func (m measurementT) formatValue() string {
+	if m.Value == nil {
+		return "(invalid)"
+	}
+	item, _, _ := strings.Cut(m.Name, " ")
+	for _, u := range measurementUnits {
+		if strings.HasPrefix(item, u.prefix) {
+			if u.unit == "" {
+				return strconv.FormatFloat(*m.Value, 'g', 6, 64)
+			}
+			return formatSI(*m.Value, u.unit)
+		}
+	}
+	return strconv.FormatFloat(*m.Value, 'g', 6, 64)
+}
+
+// canonicalMeasurement converts a user supplied measurement (e.g. "vpp chan1") to its canonical
+// form (e.g. "VPP CH1").
+func canonicalMeasurement(measurement string) (string, error) {
+	if _, err := measurementSCPI(measurement); err != nil {
+		return "", err
+	}
+	fields := strings.Fields(measurement)
+	source, _ := canonicalSource(fields[1])
+	return strings.ToUpper(fields[0]) + " " + source, nil
+}
+
+// parseMeasurements parses a comma separated list of measurements, e.g. "VPP CH1, FREQ CH1".
+func parseMeasurements(list string) ([]string, error) {
+	measurements := []string{}
+	for _, measurement := range strings.Split(list, ",") {
+		if strings.TrimSpace(measurement) == "" {
+			continue
+		}
+		canonical, err := canonicalMeasurement(measurement)
+		if err != nil {
+			return nil, err
+		}
+		measurements = appendMeasurement(measurements, canonical)
+	}
+	return measurements, nil
+}
+
+// appendMeasurement appends a canonical measurement to a list unless it is already there.
+func appendMeasurement(measurements []string, measurement string) []string {
+	for _, m := range measurements {
+		if m == measurement {
+			return measurements
+		}
+	}
+	return append(measurements, measurement)
+}
+
+// queryMeasurements reads the given measurements (which the scope needn't be showing) for
+// recording with a capture.
+func queryMeasurements(conn net.Conn, measurements []string) ([]measurementT, error) {
+	if len(measurements) == 0 {
+		return nil, nil
+	}
+	log.InfoPrint("Reading measurements...")
+	results := []measurementT{}
+	for _, measurement := range measurements {
+		value, valid, err := queryMeasurement(conn, measurement)
+		if err != nil {
+			return nil, err
+		}
+		result := measurementT{Name: measurement}
+		if valid {
+			result.Value = &value
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// measurementSCPI converts a measurement such as "VPP CH1" to its SCPI parameters, e.g.
+// "VPP,CHAN1".
+func measurementSCPI(measurement string) (string, error) {
+	fields := strings.Fields(measurement)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("measurement %q is not of the form \"ITEM SOURCE\" (e.g. \"VPP CH1\")", measurement)
+	}
+	source, err := canonicalSource(fields[1])
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(source, "CH"):
+		source = "CHAN" + strings.TrimPrefix(source, "CH")
+	case source != "MATH":
+		return "", fmt.Errorf("measurement %q has an unsupported source (expected CH1-CH%d or MATH)",
+			measurement, maxAnalogChannel)
+	}
+	return strings.ToUpper(fields[0]) + "," + source, nil
+}
+
+// queryMeasurement reads a measurement such as "VPP CH1", and returns whether the scope could
+// make it.
+func queryMeasurement(conn net.Conn, measurement string) (float64, bool, error) {
+	scpi, err := measurementSCPI(measurement)
+	if err != nil {
+		return 0, false, err
+	}
+	value, err := command(conn, ":MEAS:ITEM? "+scpi)
+	if err != nil {
+		return 0, false, err
+	}
+	// The scope reports 9.9E37 when it can't make a measurement
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number > 1e37 {
+		return 0, false, nil
+	}
+	return number, true, nil
+}
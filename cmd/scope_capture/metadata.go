@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pngMetadataKeyword is the keyword of the PNG iTXt chunk holding a capture's captureRecordT.
+const pngMetadataKeyword = "scope_capture"
+
+// The kinds of image derived from captures, which are recorded in their metadata so that they
+// are never mistaken for captures, whatever they are named.
+const (
+	kindAnimation  = "animation"
+	kindCheck      = "check"
+	kindComparison = "comparison"
+	kindComposite  = "composite"
+)
+
+var pngSignature = []byte{137, 80, 78, 71, 13, 10, 26, 10}
+
+// embedPNGMetadata returns a copy of pngData with record stored (as JSON) in an iTXt chunk
+// immediately after the IHDR chunk. iTXt is used rather than tEXt because notes and labels may
+// contain non Latin-1 characters.
+func embedPNGMetadata(pngData []byte, record captureRecordT) ([]byte, error) {
+	// The record describes the file it is embedded in, so neither the path nor the digest are
+	// meaningful here.
+	record.Path = ""
+	record.SHA256 = ""
+	text, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	// keyword, null, compression flag, compression method, language tag + null,
+	// translated keyword + null, text
+	chunkData := append([]byte(pngMetadataKeyword), 0, 0, 0, 0, 0)
+	chunkData = append(chunkData, text...)
+
+	ihdrEnd, err := pngChunkEnd(pngData, len(pngSignature))
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(nil)
+	out.Write(pngData[:ihdrEnd])
+	writePNGChunk(out, "iTXt", chunkData)
+	out.Write(pngData[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+// writePNGChunk writes a single PNG chunk (length, type, data, CRC) to buffer.
+func writePNGChunk(buffer *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	buffer.WriteString(chunkType)
+	buffer.Write(data)
+	binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunkType), data...)))
+}
+
+// pngChunkEnd returns the offset just past the chunk starting at offset.
+func pngChunkEnd(pngData []byte, offset int) (int, error) {
+	if len(pngData) < offset+8 || !bytes.HasPrefix(pngData, pngSignature) {
+		return 0, errors.New("not a PNG file")
+	}
+	length := int(binary.BigEndian.Uint32(pngData[offset : offset+4]))
+	end := offset + 8 + length + 4
+	if end > len(pngData) {
+		return 0, errors.New("truncated PNG chunk")
+	}
+	return end, nil
+}
+
+// readPNGMetadata returns the captureRecordT embedded in pngData by embedPNGMetadata. ok is
+// false if there is none.
+func readPNGMetadata(pngData []byte) (record captureRecordT, ok bool, err error) {
+	offset := len(pngSignature)
+	for offset < len(pngData) {
+		end, err := pngChunkEnd(pngData, offset)
+		if err != nil {
+			return record, false, err
+		}
+		chunkType := string(pngData[offset+4 : offset+8])
+		chunkData := pngData[offset+8 : end-4]
+		if chunkType == "iTXt" && bytes.HasPrefix(chunkData, append([]byte(pngMetadataKeyword), 0)) {
+			// Skip keyword, null, compression flag and method, then the language tag and
+			// translated keyword (both null terminated)
+			text := chunkData[len(pngMetadataKeyword)+3:]
+			for i := 0; i < 2; i++ {
+				nul := bytes.IndexByte(text, 0)
+				if nul < 0 {
+					return record, false, errors.New("malformed iTXt chunk")
+				}
+				text = text[nul+1:]
+			}
+			if err := json.Unmarshal(text, &record); err != nil {
+				return record, false, fmt.Errorf("failed to parse metadata: %v", err)
+			}
+			return record, true, nil
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			// Our metadata always precedes the image data
+			break
+		}
+		offset = end
+	}
+	return record, false, nil
+}
+
+// sidecarPath returns the path of the JSON metadata file which may accompany an image.
+func sidecarPath(imagePath string) string {
+	return imagePath + ".json"
+}
+
+// writeSidecar writes record (as JSON) to the sidecar file of an image which can't hold
+// embedded metadata.
+func writeSidecar(imagePath string, record captureRecordT) error {
+	// As for embedded metadata, the record describes the file it accompanies
+	record.Path = ""
+	record.SHA256 = ""
+	text, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	return writeFileAtomic(sidecarPath(imagePath), append(text, '\n'))
+}
+
+// writeDerivedImage writes an encoded image derived from captures (e.g. a comparison), with
+// metadata recording its kind: embedded if it is a PNG, otherwise in a sidecar file.
+func writeDerivedImage(path string, data []byte, kind string) error {
+	record := captureRecordT{Time: time.Now(), Session: sessionID, Host: config.Hostname, Kind: kind}
+	embeds := bytes.HasPrefix(data, pngSignature)
+	if embeds {
+		var err error
+		if data, err = embedPNGMetadata(data, record); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	if !embeds {
+		return writeSidecar(path, record)
+	}
+	return nil
+}
+
+// readCaptureMetadata returns the metadata for the capture at path, from the metadata embedded
+// in the image or, failing that, from a sidecar file. ok is false if neither exist.
+func readCaptureMetadata(path string) (record captureRecordT, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return record, false, err
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		record, ok, err = readPNGMetadata(data)
+		if ok || err != nil {
+			return record, ok, err
+		}
+	}
+	sidecar, err := os.ReadFile(sidecarPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	if err := json.Unmarshal(sidecar, &record); err != nil {
+		return record, false, fmt.Errorf("failed to parse %q: %v", sidecarPath(path), err)
+	}
+	record.Path = filepath.Base(path)
+	return record, true, nil
+}
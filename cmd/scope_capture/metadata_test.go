@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPNG returns a small encoded PNG.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	img.Set(1, 1, color.RGBA{247, 250, 82, 255})
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+func testRecord() captureRecordT {
+	volts := 2.96
+	return captureRecordT{
+		Path:       "Startup.png",
+		Time:       time.Date(2025, 1, 16, 19, 24, 33, 123000000, time.UTC),
+		Session:    "20250116-192433-3f9a",
+		Host:       "bench1",
+		Instrument: parseInstrumentID("RIGOL TECHNOLOGIES,DS1054Z,DS1ZA221102281,00.04.04.SP4"),
+		Note:       "Démarrage → 3V3 ✓",
+		Labels:     []labelT{{Source: "CH1", Text: "Vin"}, {Source: "D0-D7", Text: "Data"}},
+		Settings:   map[string]string{"timebase": "5.000000e-04", "ch1_scale": "1.000000e+00"},
+		SHA256:     "0123",
+		Measurements: []measurementT{
+			{Name: "VPP CH1", Value: &volts},
+			{Name: "FREQ CH2"},
+		},
+	}
+}
+
+func TestPNGMetadataRoundTrip(t *testing.T) {
+	pngData := testPNG(t)
+	record := testRecord()
+	embedded, err := embedPNGMetadata(pngData, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := readPNGMetadata(embedded)
+	if err != nil || !ok {
+		t.Fatalf("readPNGMetadata() = %v, %v", ok, err)
+	}
+	// The path and digest describe the file, so aren't embedded in it
+	want := record
+	want.Path, want.SHA256 = "", ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readPNGMetadata() = %+v, want %+v", got, want)
+	}
+
+	// The image itself is unchanged
+	img, err := png.Decode(bytes.NewReader(embedded))
+	if err != nil {
+		t.Fatalf("the PNG with metadata doesn't decode: %v", err)
+	}
+	original, _ := png.Decode(bytes.NewReader(pngData))
+	if !reflect.DeepEqual(img, original) {
+		t.Errorf("embedding metadata changed the image")
+	}
+}
+
+func TestReadPNGMetadataWithout(t *testing.T) {
+	if _, ok, err := readPNGMetadata(testPNG(t)); ok || err != nil {
+		t.Errorf("readPNGMetadata() of a plain PNG = %v, %v; want no metadata and no error", ok, err)
+	}
+	embedded, err := embedPNGMetadata(testPNG(t), testRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readPNGMetadata(embedded[:60]); err == nil {
+		t.Errorf("readPNGMetadata() of a truncated PNG didn't fail")
+	}
+	if _, err := embedPNGMetadata([]byte("GIF89a"), testRecord()); err == nil {
+		t.Errorf("embedPNGMetadata() of a GIF didn't fail")
+	}
+}
+
+func TestSidecarMetadataRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Startup.jpg")
+	if err := os.WriteFile(path, []byte("not a PNG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := readCaptureMetadata(path); ok || err != nil {
+		t.Errorf("readCaptureMetadata() without a sidecar = %v, %v; want no metadata and no error", ok, err)
+	}
+
+	record := testRecord()
+	if err := writeSidecar(path, record); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := readCaptureMetadata(path)
+	if err != nil || !ok {
+		t.Fatalf("readCaptureMetadata() = %v, %v", ok, err)
+	}
+	// The path is that of the image the sidecar accompanies
+	want := record
+	want.Path, want.SHA256 = "Startup.jpg", ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readCaptureMetadata() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scopeToken is the filename template token which is replaced by the scope's name.
+const scopeToken = "{scope}"
+
+// namedScopeT is one of the scopes captured by -scopes.
+type namedScopeT struct {
+	Name string
+	scopeT
+}
+
+// lookupScopes resolves a comma separated list of scopes, each either a name from the config
+// file's "scopes" or a HOST[:PORT] address.
+func lookupScopes(list string) ([]namedScopeT, error) {
+	scopes := []namedScopeT{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("scope %q is listed more than once", name)
+		}
+		seen[name] = true
+		scope, ok := config.Scopes[name]
+		if !ok {
+			// Not a configured scope, so an address
+			scope = scopeT{Hostname: name}
+			if host, port, err := net.SplitHostPort(name); err == nil {
+				number, err := strconv.Atoi(port)
+				if err != nil {
+					return nil, fmt.Errorf("invalid port in scope address %q", name)
+				}
+				scope = scopeT{Hostname: host, Port: number}
+			}
+		}
+		if scope.Port == 0 {
+			scope.Port = config.ScopePort
+		}
+		scopes = append(scopes, namedScopeT{Name: name, scopeT: scope})
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scopes given")
+	}
+	return scopes, nil
+}
+
+// withScopeName returns a filename template which contains {scope}, adding "_{scope}" before
+// the extension if necessary, so that each scope's capture is named after it.
+func withScopeName(template string) string {
+	if strings.Contains(template, scopeToken) {
+		return template
+	}
+	ext := filepath.Ext(template)
+	return strings.TrimSuffix(template, ext) + "_" + scopeToken + ext
+}
+
+// inParallel calls f(0) .. f(n-1) concurrently, and waits for them all to return.
+func inParallel(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// scopeErrors logs the error (if any) of each scope, and returns an error if there were any.
+func scopeErrors(scopes []namedScopeT, errs []error) error {
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			log.ErrorPrintf("Scope %q: %v", scopes[i].Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scopes failed", failed, len(scopes))
+	}
+	return nil
+}
+
+// runMultiScope captures from several scopes at once, each over its own session. With -single
+// or -wait-trigger every scope is armed (or waited on) at the same time, and each is captured as
+// soon as it has triggered. Every capture shares the app's session ID, is named and labelled
+// after its scope, is annotated using its scope's layout, goes to its scope's output directory
+// (if it has one) and is stacked with the others in a composite image.
+func runMultiScope(scopes []namedScopeT, options captureOptionsT, timeLapse timeLapseT, trigger triggerT) error {
+	if timeLapse.enabled() || trigger.Loop {
+		return fmt.Errorf("-scopes can't be combined with time-lapse or -loop capture")
+	}
+
+	// Connect to every scope before capturing from any
+	sessions := make([]*sessionT, len(scopes))
+	errs := make([]error, len(scopes))
+	inParallel(len(scopes), func(i int) {
+		sessions[i], errs[i] = openSession(scopes[i].Hostname, scopes[i].Port)
+	})
+	defer func() {
+		for _, session := range sessions {
+			if session != nil {
+				session.Close()
+			}
+		}
+	}()
+	if err := scopeErrors(scopes, errs); err != nil {
+		return err
+	}
+	if options.Recipe != nil {
+		for i, session := range sessions {
+			log.InfoPrintf("Scope %q:", scopes[i].Name)
+			if _, err := options.Recipe.apply(session.Conn); err != nil {
+				return fmt.Errorf("scope %q: %v", scopes[i].Name, err)
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	options.Filename = withScopeName(filenameTemplate(options.Filename, options.Note))
+	records := make([]captureRecordT, len(scopes))
+	inParallel(len(scopes), func(i int) {
+		scopeOptions := options
+		scopeOptions.Scope, scopeOptions.Layout = scopes[i].Name, scopes[i].Layout
+		if scopes[i].OutputDir != "" {
+			scopeOptions.OutputDir = scopes[i].OutputDir
+		}
+		// The command line labels replace the scope's own
+		scopeLabels, _ := scopes[i].labels()
+		scopeOptions.Labels = replaceLabels(scopeLabels, nil, options.Labels)
+		if trigger.enabled() {
+			if errs[i] = waitForTrigger(ctx, sessions[i], trigger.Single, trigger.Timeout); errs[i] != nil {
+				return
+			}
+		}
+		records[i], errs[i] = captureOnce(sessions[i], scopeOptions)
+	})
+	if err := scopeErrors(scopes, errs); err != nil {
+		return err
+	}
+
+	earliest, latest := records[0].Time, records[0].Time
+	for _, record := range records {
+		if record.Time.Before(earliest) {
+			earliest = record.Time
+		}
+		if record.Time.After(latest) {
+			latest = record.Time
+		}
+	}
+	log.InfoPrintf("Captured %d scopes, within %v of each other.", len(scopes), latest.Sub(earliest).Round(time.Millisecond))
+	return writeComposite(scopes, records)
+}
+
+// writeComposite stacks the scopes' annotated captures (so that their time axes line up, if
+// their timebases match), each under a caption naming its scope, and writes the result as
+// composite_{date}_{time}.png alongside the first capture.
+func writeComposite(scopes []namedScopeT, records []captureRecordT) error {
+	images := []image.Image{}
+	width, height := 0, 0
+	for _, record := range records {
+		img, err := readCaptureImage(record.Path)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+		width = max(width, img.Bounds().Dx())
+		height += captionHeight + img.Bounds().Dy()
+	}
+	composite := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(composite, composite.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	y := 0
+	for i, img := range images {
+		record := records[i]
+		caption := fmt.Sprintf("%s: %s %s  %s", scopes[i].Name, record.Instrument.Model, record.Instrument.Serial,
+			record.Time.Format("2006-01-02 15:04:05.000"))
+		addLabel(composite, caption, 4, y+2, colorNote)
+		y += captionHeight
+		size := img.Bounds().Size()
+		draw.Draw(composite, image.Rect(0, y, size.X, y+size.Y), img, img.Bounds().Min, draw.Src)
+		y += size.Y
+	}
+
+	data, err := encodePNG(composite, encodeOptionsT{})
+	if err != nil {
+		return err
+	}
+	path, err := allocateOutputFile(filepath.Join(filepath.Dir(records[0].Path),
+		"composite_"+records[0].Time.Format("2006-01-02_15-04-05")+".png"), 0)
+	if err != nil {
+		return err
+	}
+	if err := writeDerivedImage(path, data, kindComposite); err != nil {
+		os.Remove(path)
+		return err
+	}
+	log.InfoPrintf("Wrote composite of %d scopes to %q.", len(scopes), path)
+	return nil
+}
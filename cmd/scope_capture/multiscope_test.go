@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookupScopes(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.ScopePort = 5555
+	config.Scopes = map[string]scopeT{
+		"left":  {Hostname: "10.0.0.1", Layout: "ds1000z"},
+		"right": {Hostname: "10.0.0.2", Port: 5025},
+	}
+
+	tests := []struct {
+		list string
+		want []namedScopeT
+		ok   bool
+	}{
+		{"left, right", []namedScopeT{
+			{Name: "left", scopeT: scopeT{Hostname: "10.0.0.1", Port: 5555, Layout: "ds1000z"}},
+			{Name: "right", scopeT: scopeT{Hostname: "10.0.0.2", Port: 5025}},
+		}, true},
+		// Anything else is an address
+		{"left,10.0.0.3,scope.local:5556,[::1]:5557,,", []namedScopeT{
+			{Name: "left", scopeT: scopeT{Hostname: "10.0.0.1", Port: 5555, Layout: "ds1000z"}},
+			{Name: "10.0.0.3", scopeT: scopeT{Hostname: "10.0.0.3", Port: 5555}},
+			{Name: "scope.local:5556", scopeT: scopeT{Hostname: "scope.local", Port: 5556}},
+			{Name: "[::1]:5557", scopeT: scopeT{Hostname: "::1", Port: 5557}},
+		}, true},
+		{"left,left", nil, false},
+		{"scope.local:scpi", nil, false},
+		{"", nil, false},
+		{" , ", nil, false},
+	}
+	for _, test := range tests {
+		got, err := lookupScopes(test.list)
+		if (err == nil) != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lookupScopes(%q) = %+v, %v; want %+v (ok %v)", test.list, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestWithScopeName(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{date}_{time}.{ext}", "{date}_{time}_{scope}.{ext}"},
+		{"{scope}/{note}.png", "{scope}/{note}.png"},
+		{"{note}_{scope}_{seq}.png", "{note}_{scope}_{seq}.png"},
+		{"capture", "capture_{scope}"},
+	}
+	for _, test := range tests {
+		if got := withScopeName(test.template); got != test.want {
+			t.Errorf("withScopeName(%q) = %q; want %q", test.template, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxUniqueFileAttempts bounds the search for an unused output filename.
+const maxUniqueFileAttempts = 100000
+
+// allocateOutputFile reserves a unique output filename by creating an empty placeholder file
+// with O_EXCL, so that two captures writing into the same (possibly shared) directory can never
+// pick the same name. If path contains {seq} then increasing sequence numbers (starting from
+// firstSeq) are tried, otherwise path itself is tried first followed by "_2", "_3" etc. inserted
+// before the extension. The placeholder is later replaced by writeFileAtomic.
+func allocateOutputFile(path string, firstSeq int) (string, error) {
+	if !strings.Contains(path, seqToken) || firstSeq < 1 {
+		firstSeq = 1
+	}
+	for i := firstSeq; i < firstSeq+maxUniqueFileAttempts; i++ {
+		candidate := uniqueFileCandidate(path, i)
+		file, err := os.OpenFile(candidate, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			file.Close()
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("failed to create output file %q: %v", candidate, err)
+		}
+	}
+	return "", fmt.Errorf("unable to find an unused filename for %q", path)
+}
+
+// uniqueFileCandidate returns the n'th (1 based) candidate filename for path.
+func uniqueFileCandidate(path string, n int) string {
+	if strings.Contains(path, seqToken) {
+		return strings.ReplaceAll(path, seqToken, fmt.Sprintf(seqFormat, n))
+	}
+	if n == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as path and then
+// renames it over path, so that a crash never leaves a partially written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %q: %v", path, err)
+	}
+	tempPath := tempFile.Name()
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write %q: %v", path, err)
+	}
+	return nil
+}
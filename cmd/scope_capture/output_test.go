@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAllocateOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		path     string
+		firstSeq int
+		want     string
+	}{
+		{"shot.png", 0, "shot.png"},
+		{"shot.png", 0, "shot_2.png"},
+		{"shot.png", 7, "shot_3.png"},
+		{"shot", 0, "shot"},
+		{"shot", 0, "shot_2"},
+		{"archive.tar.gz", 0, "archive.tar.gz"},
+		{"archive.tar.gz", 0, "archive.tar_2.gz"},
+		{"t_{seq}.png", 0, "t_001.png"},
+		{"t_{seq}.png", 1, "t_002.png"},
+		{"t_{seq}.png", 5, "t_005.png"},
+		{"t_{seq}.png", 5, "t_006.png"},
+		// The directory must exist
+		{"missing/shot.png", 0, ""},
+	}
+	for _, test := range tests {
+		got, err := allocateOutputFile(filepath.Join(dir, test.path), test.firstSeq)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("allocateOutputFile(%q, %d) = %q, want an error", test.path, test.firstSeq, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.Join(dir, test.want) {
+			t.Errorf("allocateOutputFile(%q, %d) = %q, %v; want %q", test.path, test.firstSeq, got, err, test.want)
+		}
+	}
+}
+
+func TestAllocateOutputFileConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	const n = 20
+	paths := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = allocateOutputFile(filepath.Join(dir, "shot.png"), 0)
+		}(i)
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for i, path := range paths {
+		if errs[i] != nil {
+			t.Fatalf("allocateOutputFile() failed: %v", errs[i])
+		}
+		if seen[path] {
+			t.Errorf("%q was allocated more than once", path)
+		}
+		seen[path] = true
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path, err := allocateOutputFile(filepath.Join(dir, "shot.png"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "image" {
+		t.Errorf("read %q, %v; want %q", data, err, "image")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the output file", len(entries))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultPaletteName = "scope"
+
+// palettes hold the annotation color for each source kind (see sourceKind).
+var palettes = map[string]map[string]color.Color{
+	// The trace colors of the DS1000Z
+	"scope": colorSources,
+	// The Okabe-Ito palette, which is distinguishable with the common forms of color blindness
+	"colorblind": {
+		"CH1":  color.RGBA{240, 228, 66, 255},  // Yellow
+		"CH2":  color.RGBA{86, 180, 233, 255},  // Sky blue
+		"CH3":  color.RGBA{230, 159, 0, 255},   // Orange
+		"CH4":  color.RGBA{0, 158, 115, 255},   // Bluish green
+		"MATH": color.RGBA{204, 121, 167, 255}, // Reddish purple
+		"REF":  color.RGBA{213, 94, 0, 255},    // Vermillion
+		"D":    color.RGBA{0, 114, 178, 255},   // Blue
+	},
+	// Distinct shades of grey, best combined with -markers
+	"mono": {
+		"CH1":  color.RGBA{255, 255, 255, 255},
+		"CH2":  color.RGBA{210, 210, 210, 255},
+		"CH3":  color.RGBA{170, 170, 170, 255},
+		"CH4":  color.RGBA{135, 135, 135, 255},
+		"MATH": color.RGBA{230, 230, 230, 255},
+		"REF":  color.RGBA{190, 190, 190, 255},
+		"D":    color.RGBA{150, 150, 150, 255},
+	},
+}
+
+// markerPatterns hold the line style drawn next to each source kind's labels with -markers.
+// Each pattern is repeated along the marker: true is a drawn pixel, false a gap.
+var markerPatterns = map[string][]bool{
+	"CH1":  {true},                                                     // Solid
+	"CH2":  {true, true, true, true, false, false},                     // Dashed
+	"CH3":  {true, false},                                              // Dotted
+	"CH4":  {true, true, true, true, false, false, true, false, false}, // Dash-dot
+	"MATH": {true, true, true, true, true, true, true, false, false, false},
+	"REF":  {true, true, false, true, false, false},
+	"D":    {true, true, false, false},
+}
+
+// paletteNames returns the names of the palettes, for usage and error messages.
+func paletteNames() string {
+	names := []string{}
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checkPalette returns an error if name is not a palette name or "" (the default).
+func checkPalette(name string) error {
+	if _, ok := palettes[strings.ToLower(name)]; name != "" && !ok {
+		return fmt.Errorf("unknown palette %q (expected one of %s)", name, paletteNames())
+	}
+	return nil
+}
+
+// parseColors converts the config file's "colors" (source name or kind to "#rrggbb") into
+// annotation color overrides, keyed by canonical source name or kind.
+func parseColors(colors map[string]string) (map[string]color.Color, error) {
+	parsed := map[string]color.Color{}
+	for source, hex := range colors {
+		key := strings.ToUpper(strings.TrimSpace(source))
+		if key != "REF" && key != "D" {
+			var err error
+			if key, err = canonicalSource(source); err != nil {
+				return nil, err
+			}
+		}
+		c, err := parseHexColor(hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid color for %s: %v", source, err)
+		}
+		parsed[key] = c
+	}
+	return parsed, nil
+}
+
+// parseHexColor parses a "#rrggbb" color.
+func parseHexColor(hex string) (color.Color, error) {
+	digits := strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if len(digits) != 6 || err != nil {
+		return nil, fmt.Errorf("%q is not of the form #rrggbb", hex)
+	}
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, nil
+}
+
+// sourceMarker returns the line style for a canonical source name's labels.
+func sourceMarker(source string) []bool {
+	return markerPatterns[sourceKind(source)]
+}
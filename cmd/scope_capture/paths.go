@@ -1,4 +1,53 @@
 package main
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
 const pathDirLogs = "./logs"
 const pathDirScopeCaptures = "./scope_captures"
+
+// envOutputDir names the environment variable which can set the output directory.
+const envOutputDir = "SCOPE_CAPTURE_OUTDIR"
+
+// outputDirTemplate returns the output directory (template) to use. The command line wins, then
+// the environment, then the config file, then the default.
+func outputDirTemplate(flagOutputDir string) string {
+	if flagOutputDir != "" {
+		log.InfoPrintf("Adopting output directory from command line: %q", flagOutputDir)
+		return flagOutputDir
+	}
+	if dir := os.Getenv(envOutputDir); dir != "" {
+		log.InfoPrintf("Adopting output directory from $%s: %q", envOutputDir, dir)
+		return dir
+	}
+	if config.OutputDir != "" {
+		return config.OutputDir
+	}
+	return pathDirScopeCaptures
+}
+
+// resolveOutputDir expands the tokens in an output directory template (e.g.
+// "~/captures/{project}/{yyyy-mm-dd}/"), expands a leading "~" to the user's home directory and
+// creates the directory if it does not already exist.
+func resolveOutputDir(template string, ctx templateContextT) (string, error) {
+	dir, err := expandTemplate(template, ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to build output directory: %w", err)
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to expand %q: %v", dir, err)
+		}
+		dir = filepath.Join(homeDir, dir[1:])
+	}
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory %q: %v", dir, err)
+	}
+	return dir, nil
+}
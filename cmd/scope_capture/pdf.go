@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"strings"
+)
+
+// A minimal PDF writer: just enough to lay out text in the standard (non-embedded) fonts and
+// RGB images, so that reports can be produced without an external renderer.
+
+const (
+	pdfPageWidth  = 595.0 // A4, in points
+	pdfPageHeight = 842.0
+)
+
+type pdfFontT string
+
+const (
+	pdfFontRegular pdfFontT = "F1"
+	pdfFontBold    pdfFontT = "F2"
+	pdfFontMono    pdfFontT = "F3"
+)
+
+var pdfFontNames = map[pdfFontT]string{
+	pdfFontRegular: "Helvetica",
+	pdfFontBold:    "Helvetica-Bold",
+	pdfFontMono:    "Courier",
+}
+
+// Glyph widths (in 1/1000 em) of the printable ASCII characters, from the standard AFM files.
+var (
+	helveticaWidths = [95]int{
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	}
+	helveticaBoldWidths = [95]int{
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	}
+)
+
+// pdfTextWidth returns the width in points of text set in font at size.
+func pdfTextWidth(text string, font pdfFontT, size float64) float64 {
+	total := 0
+	for _, ch := range pdfEncode(text) {
+		switch {
+		case font == pdfFontMono:
+			total += 600
+		case ch < 32 || ch > 126:
+			total += 556
+		case font == pdfFontBold:
+			total += helveticaBoldWidths[ch-32]
+		default:
+			total += helveticaWidths[ch-32]
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfEncode converts text to the WinAnsi encoding used by the standard fonts. Characters which
+// can't be represented become "?".
+func pdfEncode(text string) []byte {
+	out := []byte{}
+	for _, r := range text {
+		if r < 256 && (r >= 32 && r < 127 || r >= 160) {
+			out = append(out, byte(r))
+		} else {
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+// pdfEscape returns text as a PDF string literal.
+func pdfEscape(text string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, ch := range pdfEncode(text) {
+		switch ch {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		default:
+			if ch >= 128 {
+				fmt.Fprintf(&b, "\\%03o", ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// pdfT is a PDF document under construction.
+type pdfT struct {
+	// objects[i] is the body of object number i+1
+	objects [][]byte
+	pages   []*pdfPageT
+}
+
+// pdfPageT is a single page. Coordinates are in points from the bottom left of the page.
+type pdfPageT struct {
+	content bytes.Buffer
+	// images maps resource names (e.g. "Im1") to image object numbers
+	images map[string]int
+}
+
+func newPDF() *pdfT {
+	return &pdfT{}
+}
+
+// addObject adds an object and returns its object number.
+func (p *pdfT) addObject(body []byte) int {
+	p.objects = append(p.objects, body)
+	return len(p.objects)
+}
+
+func (p *pdfT) addPage() *pdfPageT {
+	page := &pdfPageT{images: map[string]int{}}
+	p.pages = append(p.pages, page)
+	return page
+}
+
+// text draws a single line of text with its baseline at y.
+func (page *pdfPageT) text(x, y float64, font pdfFontT, size float64, text string) {
+	fmt.Fprintf(&page.content, "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, y, pdfEscape(text))
+}
+
+// textColor draws a single line of text in an RGB color (components 0-1).
+func (page *pdfPageT) textColor(x, y float64, font pdfFontT, size float64, text string, r, g, b float64) {
+	fmt.Fprintf(&page.content, "%.3f %.3f %.3f rg\n", r, g, b)
+	page.text(x, y, font, size, text)
+	fmt.Fprintf(&page.content, "0 0 0 rg\n")
+}
+
+// image draws img with its bottom left corner at (x, y), scaled to width x height points.
+func (p *pdfT) image(page *pdfPageT, img image.Image, x, y, width, height float64) error {
+	bounds := img.Bounds()
+	rgb := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			r, g, b, _ := img.At(px, py).RGBA()
+			rgb = append(rgb, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+	}
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	if _, err := w.Write(rgb); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB "+
+		"/BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n",
+		bounds.Dx(), bounds.Dy(), compressed.Len())
+	body.Write(compressed.Bytes())
+	body.WriteString("\nendstream")
+	objectNumber := p.addObject(body.Bytes())
+
+	name := fmt.Sprintf("Im%d", objectNumber)
+	page.images[name] = objectNumber
+	fmt.Fprintf(&page.content, "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n", width, height, x, y, name)
+	return nil
+}
+
+// bytes returns the finished document.
+func (p *pdfT) bytes() []byte {
+	// Fonts
+	fontRefs := []string{}
+	for _, font := range []pdfFontT{pdfFontRegular, pdfFontBold, pdfFontMono} {
+		n := p.addObject([]byte(fmt.Sprintf(
+			"<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", pdfFontNames[font])))
+		fontRefs = append(fontRefs, fmt.Sprintf("/%s %d 0 R", font, n))
+	}
+
+	// The page tree's object number must be known before the pages are written, so reserve it
+	pagesNumber := p.addObject(nil)
+	kids := []string{}
+	for _, page := range p.pages {
+		var stream bytes.Buffer
+		fmt.Fprintf(&stream, "<< /Length %d >>\nstream\n", page.content.Len())
+		stream.Write(page.content.Bytes())
+		stream.WriteString("\nendstream")
+		contentNumber := p.addObject(stream.Bytes())
+
+		images := []string{}
+		for name, n := range page.images {
+			images = append(images, fmt.Sprintf("/%s %d 0 R", name, n))
+		}
+		pageNumber := p.addObject([]byte(fmt.Sprintf(
+			"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.0f %.0f] /Contents %d 0 R "+
+				"/Resources << /Font << %s >> /XObject << %s >> >> >>",
+			pagesNumber, pdfPageWidth, pdfPageHeight, contentNumber,
+			strings.Join(fontRefs, " "), strings.Join(images, " "))))
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageNumber))
+	}
+	p.objects[pagesNumber-1] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>",
+		strings.Join(kids, " "), len(kids)))
+	catalogNumber := p.addObject([]byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesNumber)))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(p.objects))
+	for i, body := range p.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(body)
+		out.WriteString("\nendobj\n")
+	}
+	xrefOffset := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(p.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(p.objects)+1, catalogNumber, xrefOffset)
+	return out.Bytes()
+}
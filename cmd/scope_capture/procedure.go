@@ -0,0 +1,790 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultExportFile is the filename template of an export step's CSV.
+const defaultExportFile = "{date}_{time}_waveforms.csv"
+
+var (
+	// variablePattern matches a variable reference, e.g. "${serial}"
+	variablePattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+	variableName    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// procedureT is a test procedure: a sequence of steps run against one scope session by the run
+// subcommand.
+type procedureT struct {
+	// Name is the procedure file's name, recorded with each capture
+	Name string `json:"-"`
+	// Variables are substituted for ${NAME} in the steps. They may be overridden with -var.
+	Variables map[string]string `json:"variables"`
+	Steps     []stepT           `json:"steps"`
+}
+
+// stepT is one step of a procedure. Exactly one action (SCPI, Query, Set, Wait, WaitTrigger,
+// Prompt, Recipe, Capture, Export or Assert) is given.
+type stepT struct {
+	// Name (optional) describes the step in the summary
+	Name string `json:"name,omitempty"`
+	// SCPI is a command to send
+	SCPI string `json:"scpi,omitempty"`
+	// Query is a SCPI query, whose response is stored in the variable named by Into
+	Query string `json:"query,omitempty"`
+	// Set sets variables
+	Set map[string]string `json:"set,omitempty"`
+	// Wait is how long to pause, e.g. "500ms"
+	Wait        string            `json:"wait,omitempty"`
+	WaitTrigger *waitTriggerStepT `json:"wait_trigger,omitempty"`
+	// Prompt is shown to the operator, who responds by pressing Enter
+	Prompt string `json:"prompt,omitempty"`
+	// Recipe is a recipe file to apply
+	Recipe  string        `json:"recipe,omitempty"`
+	Capture *captureStepT `json:"capture,omitempty"`
+	Export  *exportStepT  `json:"export,omitempty"`
+	Assert  *assertStepT  `json:"assert,omitempty"`
+	// Into names the variable which receives a query's response, a prompt's response or an
+	// assert's measurement
+	Into string `json:"into,omitempty"`
+}
+
+// waitTriggerStepT waits for the scope to trigger.
+type waitTriggerStepT struct {
+	// Single arms the scope with :SING first
+	Single bool `json:"single,omitempty"`
+	// Timeout (optional) is how long to wait, e.g. "30s"
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// captureStepT captures the screen, as the app does without a subcommand.
+type captureStepT struct {
+	Note string `json:"note,omitempty"`
+	// File (optional) is the filename template, as for -file
+	File string `json:"file,omitempty"`
+	// Labels are keyed by source, e.g. {"CH1": "Clock"}
+	Labels    map[string]string `json:"labels,omitempty"`
+	Waveforms bool              `json:"waveforms,omitempty"`
+}
+
+// exportStepT saves waveforms as CSV.
+type exportStepT struct {
+	// Sources are analog channels (Defaults to the displayed channels)
+	Sources []string `json:"sources,omitempty"`
+	// File (optional) is the CSV's filename template, in the output directory
+	File string `json:"file,omitempty"`
+}
+
+// assertStepT checks a measurement against limits.
+type assertStepT struct {
+	// Measurement is e.g. "VPP CH1" (see measurementSCPI)
+	Measurement string `json:"measurement"`
+	// Min and Max (either may be omitted) may have SI prefixes and units, e.g. "1.8V" or "10kHz"
+	Min string `json:"min,omitempty"`
+	Max string `json:"max,omitempty"`
+}
+
+// variablesFlag collects repeated `-var NAME=VALUE` command line arguments.
+type variablesFlag map[string]string
+
+func (v *variablesFlag) String() string {
+	items := []string{}
+	for name, value := range *v {
+		items = append(items, name+"="+value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (v *variablesFlag) Set(value string) error {
+	name, text, found := strings.Cut(value, "=")
+	if !found || !variableName.MatchString(name) {
+		return fmt.Errorf("variable %q is not of the form NAME=VALUE", value)
+	}
+	if *v == nil {
+		*v = variablesFlag{}
+	}
+	(*v)[name] = text
+	return nil
+}
+
+// runProcedure runs a procedure file's steps against one scope session, then prints a summary.
+// A failed assertion doesn't stop the procedure, but any other error does. If any step failed
+// then so does the run (so the app exits non-zero).
+func runProcedure(args []string) error {
+	var flagOutputDir, flagProject, flagFormat, flagScopeFormat, flagTheme string
+	var flagVariables variablesFlag
+	var scope scopeFlagsT
+	fs := newSubcommandFlagSet("run", "PROCEDURE")
+	fs.Var(&flagVariables, "var", "Set a procedure variable as NAME=VALUE, overriding the procedure's value. May be repeated.")
+	scope.register(fs)
+	fs.StringVar(&flagOutputDir, "outdir", "", "Output directory, which may be a template (as for capturing)")
+	fs.StringVar(&flagProject, "project", "", "Project name, used by the {project} template token")
+	fs.StringVar(&flagFormat, "format", "",
+		fmt.Sprintf("Output image format: %s (Defaults to each capture's file extension, then png)", formatNames()))
+	fs.StringVar(&flagScopeFormat, "scope-format", "",
+		"Image format to request from the scope: png, bmp24, bmp8 or jpeg (Defaults per model, then png)")
+	fs.StringVar(&flagTheme, "theme", "", fmt.Sprintf("Color theme: %s", themeNames()))
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one procedure file")
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+	if flagProject != "" {
+		config.Project = flagProject
+	}
+	if flagTheme != "" {
+		config.Theme = flagTheme
+	}
+	if _, err := lookupTheme(config.Theme); err != nil {
+		return err
+	}
+	if _, err := selectFormat(flagFormat, ""); err != nil {
+		return err
+	}
+	if _, err := selectScopeFormat(flagScopeFormat, ""); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	procedure, err := loadProcedure(positional[0], flagVariables, start)
+	if err != nil {
+		return err
+	}
+	session, err := scope.open()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	runner := procedureRunnerT{
+		Procedure: procedure,
+		Session:   session,
+		Format:    flagFormat,
+		Options: captureOptionsT{
+			Scope:        config.Scope,
+			Procedure:    procedure.Name,
+			OutputDir:    outputDirTemplate(flagOutputDir),
+			ScopeFormat:  flagScopeFormat,
+			Theme:        config.Theme,
+			View:         defaultView,
+			Measurements: config.Measurements,
+		},
+		Variables: map[string]string{
+			"model":  session.Instrument.Model,
+			"serial": session.Instrument.Serial,
+		},
+		Input: bufio.NewReader(os.Stdin),
+	}
+	for name, value := range procedure.Variables {
+		runner.Variables[name] = value
+	}
+	results := runner.run()
+
+	// Summarize
+	counts := map[string]int{}
+	fmt.Printf("Procedure %q (%v):\n", procedure.Name, time.Since(start).Round(time.Second))
+	for i, result := range results {
+		counts[result.Result]++
+		status := result.Result
+		if status == "" {
+			status = "-"
+		}
+		line := fmt.Sprintf("%3d  %-5s  %s", i+1, status, result.Step)
+		if result.Detail != "" {
+			line += ": " + result.Detail
+		}
+		fmt.Println(line)
+	}
+	if counts["OK"] == len(results) {
+		fmt.Printf("PASS: %d step(s) passed\n", len(results))
+		return nil
+	}
+	fmt.Printf("FAIL: %d passed, %d failed, %d error(s), %d not run (of %d steps)\n",
+		counts["OK"], counts["FAIL"], counts["ERROR"], counts[""], len(results))
+	return fmt.Errorf("the procedure failed")
+}
+
+// loadProcedure reads and checks a procedure file (JSON, or YAML if it has a .yaml or .yml
+// extension). overrides replace the procedure's variables, and the built-in variables date and
+// time are set from start.
+func loadProcedure(path string, overrides map[string]string, start time.Time) (*procedureT, error) {
+	data, err := readDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	procedure := &procedureT{}
+	// Reject unknown fields, so that a misspelt action isn't silently skipped
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(procedure); err != nil {
+		return nil, fmt.Errorf("failed to parse procedure %q: %v", path, err)
+	}
+	if len(procedure.Steps) == 0 {
+		return nil, fmt.Errorf("procedure %q has no steps", path)
+	}
+	procedure.Name = path
+
+	variables := map[string]string{"date": start.Format("2006-01-02"), "time": start.Format("15-04-05")}
+	for name, value := range procedure.Variables {
+		if !variableName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name %q in procedure %q", name, path)
+		}
+		variables[name] = value
+	}
+	for name, value := range overrides {
+		if _, ok := procedure.Variables[name]; !ok {
+			return nil, fmt.Errorf("-var %s: procedure %q has no variable %q", name, path, name)
+		}
+		variables[name] = value
+	}
+	procedure.Variables = variables
+
+	// Check each step with the variables known so far. Those which are only known when the
+	// procedure runs (the scope's, and those the steps set) are checked then.
+	known := map[string]string{"model": "", "serial": ""}
+	pending := map[string]bool{"model": true, "serial": true}
+	for name, value := range variables {
+		known[name] = value
+	}
+	for i, step := range procedure.Steps {
+		action, err := step.action()
+		if err != nil {
+			return nil, fmt.Errorf("step %d of %q: %v", i+1, path, err)
+		}
+		dynamic := false
+		expanded, err := step.expand(func(text string) (string, error) {
+			for _, match := range variablePattern.FindAllStringSubmatch(text, -1) {
+				dynamic = dynamic || pending[match[1]]
+			}
+			return expandVariables(text, known)
+		})
+		if err == nil && !dynamic {
+			err = expanded.check(action)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("step %d of %q: %v", i+1, path, err)
+		}
+		defined := []string{}
+		for name := range step.Set {
+			defined = append(defined, name)
+		}
+		if step.Into != "" {
+			defined = append(defined, step.Into)
+		}
+		if action == "capture" {
+			defined = append(defined, "last_capture")
+		}
+		for _, name := range defined {
+			known[name], pending[name] = "", true
+		}
+	}
+	return procedure, nil
+}
+
+// action returns the name of the step's action, checking that it has exactly one.
+func (s stepT) action() (string, error) {
+	actions := []string{}
+	for _, action := range []struct {
+		name  string
+		given bool
+	}{
+		{"scpi", s.SCPI != ""}, {"query", s.Query != ""}, {"set", len(s.Set) > 0}, {"wait", s.Wait != ""},
+		{"wait_trigger", s.WaitTrigger != nil}, {"prompt", s.Prompt != ""}, {"recipe", s.Recipe != ""},
+		{"capture", s.Capture != nil}, {"export", s.Export != nil}, {"assert", s.Assert != nil},
+	} {
+		if action.given {
+			actions = append(actions, action.name)
+		}
+	}
+	if len(actions) != 1 {
+		return "", fmt.Errorf("expected one action (scpi, query, set, wait, wait_trigger, prompt, recipe, capture, export or assert), not %d", len(actions))
+	}
+	switch action := actions[0]; {
+	case action == "query" && s.Into == "":
+		return "", fmt.Errorf("a query needs \"into\", the variable which receives the response")
+	case s.Into != "" && action != "query" && action != "prompt" && action != "assert":
+		return "", fmt.Errorf("\"into\" may only be used with query, prompt or assert")
+	case s.Into != "" && !variableName.MatchString(s.Into):
+		return "", fmt.Errorf("invalid variable name %q", s.Into)
+	}
+	for name := range s.Set {
+		if !variableName.MatchString(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+	return actions[0], nil
+}
+
+// expand returns a copy of the step with each of its strings (other than variable names)
+// passed through expand.
+func (s stepT) expand(expand func(string) (string, error)) (stepT, error) {
+	var firstErr error
+	x := func(text string) string {
+		expanded, err := expand(text)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return expanded
+	}
+	s.Name, s.SCPI, s.Query, s.Wait, s.Prompt, s.Recipe = x(s.Name), x(s.SCPI), x(s.Query), x(s.Wait), x(s.Prompt), x(s.Recipe)
+	if s.Set != nil {
+		set := map[string]string{}
+		for name, value := range s.Set {
+			set[name] = x(value)
+		}
+		s.Set = set
+	}
+	if s.WaitTrigger != nil {
+		waitTrigger := *s.WaitTrigger
+		waitTrigger.Timeout = x(waitTrigger.Timeout)
+		s.WaitTrigger = &waitTrigger
+	}
+	if s.Capture != nil {
+		capture := *s.Capture
+		capture.Note, capture.File = x(capture.Note), x(capture.File)
+		capture.Labels = map[string]string{}
+		for source, text := range s.Capture.Labels {
+			capture.Labels[source] = x(text)
+		}
+		s.Capture = &capture
+	}
+	if s.Export != nil {
+		export := *s.Export
+		export.File = x(export.File)
+		export.Sources = nil
+		for _, source := range s.Export.Sources {
+			export.Sources = append(export.Sources, x(source))
+		}
+		s.Export = &export
+	}
+	if s.Assert != nil {
+		assert := *s.Assert
+		assert.Measurement, assert.Min, assert.Max = x(assert.Measurement), x(assert.Min), x(assert.Max)
+		s.Assert = &assert
+	}
+	return s, firstErr
+}
+
+// expandVariables substitutes variables for ${NAME} in text.
+func expandVariables(text string, variables map[string]string) (string, error) {
+	var undefined []string
+	expanded := variablePattern.ReplaceAllStringFunc(text, func(reference string) string {
+		name := variablePattern.FindStringSubmatch(reference)[1]
+		value, ok := variables[name]
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return value
+	})
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined variable %q", undefined[0])
+	}
+	return expanded, nil
+}
+
+// check checks the values of a step (with its variables substituted).
+func (s stepT) check(action string) error {
+	var err error
+	switch action {
+	case "scpi":
+		if strings.HasSuffix(strings.TrimSpace(s.SCPI), "?") {
+			err = fmt.Errorf("%q is a query (use a query step)", s.SCPI)
+		}
+	case "wait":
+		_, err = time.ParseDuration(s.Wait)
+	case "wait_trigger":
+		if s.WaitTrigger.Timeout != "" {
+			_, err = time.ParseDuration(s.WaitTrigger.Timeout)
+		}
+	case "recipe":
+		_, err = loadRecipe(s.Recipe)
+	case "capture":
+		_, err = s.Capture.labels()
+	case "export":
+		_, err = s.Export.sources()
+	case "assert":
+		if _, err = measurementSCPI(s.Assert.Measurement); err == nil {
+			_, _, err = s.Assert.limits()
+		}
+	}
+	return err
+}
+
+// describe returns a one line description of the step, for the log and summary.
+func (s stepT) describe() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	action, _ := s.action()
+	switch action {
+	case "scpi":
+		return "scpi " + s.SCPI
+	case "query":
+		return fmt.Sprintf("query %s into %s", s.Query, s.Into)
+	case "set":
+		names := []string{}
+		for name := range s.Set {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "set " + strings.Join(names, ", ")
+	case "wait":
+		return "wait " + s.Wait
+	case "wait_trigger":
+		if s.WaitTrigger.Single {
+			return "wait for single trigger"
+		}
+		return "wait for trigger"
+	case "prompt":
+		return fmt.Sprintf("prompt %q", s.Prompt)
+	case "recipe":
+		return "recipe " + s.Recipe
+	case "capture":
+		return fmt.Sprintf("capture %q", s.Capture.Note)
+	case "export":
+		if len(s.Export.Sources) == 0 {
+			return "export displayed channels"
+		}
+		return "export " + strings.Join(s.Export.Sources, ", ")
+	case "assert":
+		return "assert " + s.Assert.Measurement
+	}
+	return action
+}
+
+// labels returns the capture step's labels, in scope order.
+func (c *captureStepT) labels() ([]labelT, error) {
+	labels := []labelT{}
+	for source, text := range c.Labels {
+		label, err := parseLabel(source + "=" + text)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return mergeLabels(nil, labels), nil
+}
+
+// sources returns the export step's canonical sources, which must be analog channels.
+func (e *exportStepT) sources() ([]string, error) {
+	sources := []string{}
+	for _, name := range e.Sources {
+		source, err := canonicalSource(name)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(source, "CH") {
+			return nil, fmt.Errorf("can only export analog channels, not %q", name)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// limits returns the assert step's limits. An omitted limit is infinite.
+func (a *assertStepT) limits() (low, high float64, err error) {
+	low, high = math.Inf(-1), math.Inf(1)
+	if a.Min != "" {
+		if low, err = parseLimit(a.Min); err != nil {
+			return 0, 0, err
+		}
+	}
+	if a.Max != "" {
+		if high, err = parseLimit(a.Max); err != nil {
+			return 0, 0, err
+		}
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("min %s is greater than max %s", a.Min, a.Max)
+	}
+	return low, high, nil
+}
+
+// parseLimit parses a measurement limit, which may have an SI prefix and a unit (which isn't
+// checked against the measurement's), e.g. "1.8V", "10kHz" or "2.5ms".
+func parseLimit(text string) (float64, error) {
+	text = strings.TrimSpace(text)
+	for _, unit := range []string{"Hz", "V", "s", "%", "W", "A"} {
+		if strings.HasSuffix(text, unit) {
+			return parseSI(text, unit)
+		}
+	}
+	return parseSI(text, "")
+}
+
+// procedureRunnerT runs a procedure's steps.
+type procedureRunnerT struct {
+	Procedure *procedureT
+	Session   *sessionT
+	// Options are the capture options shared by the capture steps, and Format the -format option
+	Options captureOptionsT
+	Format  string
+	// Variables are the current values of the variables
+	Variables map[string]string
+	// Input is where the operator's responses to prompts are read from
+	Input *bufio.Reader
+}
+
+// stepResultT is the outcome of a step, for the summary.
+type stepResultT struct {
+	Step string
+	// Result is OK, FAIL (an assertion failed), ERROR, or "" if the step wasn't run
+	Result string
+	Detail string
+}
+
+// run runs the steps in order until one fails with an error or the user presses Ctrl-C, and
+// returns their results.
+func (r *procedureRunnerT) run() []stepResultT {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	steps := r.Procedure.Steps
+	results := make([]stepResultT, len(steps))
+	for i, step := range steps {
+		results[i].Step = step.describe()
+	}
+	for i, step := range steps {
+		result := &results[i]
+		expanded, err := step.expand(func(text string) (string, error) {
+			return expandVariables(text, r.Variables)
+		})
+		if err == nil {
+			result.Step = expanded.describe()
+			log.InfoPrintf("Step %d/%d: %s", i+1, len(steps), result.Step)
+			var passed bool
+			result.Detail, passed, err = r.runStep(ctx, expanded)
+			switch {
+			case err != nil || ctx.Err() != nil:
+				// Reported below
+			case passed:
+				result.Result = "OK"
+			default:
+				result.Result = "FAIL"
+				log.InfoPrintf("    FAILED: %s", result.Detail)
+			}
+		}
+		if ctx.Err() != nil {
+			result.Result, result.Detail = "ERROR", "interrupted"
+			log.InfoPrint("Interrupted.")
+			break
+		}
+		if err != nil {
+			result.Result, result.Detail = "ERROR", err.Error()
+			log.ErrorPrintf("Step %d: %v", i+1, err)
+			break
+		}
+	}
+	return results
+}
+
+// runStep runs a single step, and returns the detail for the summary and whether it passed. An
+// error stops the procedure.
+func (r *procedureRunnerT) runStep(ctx context.Context, step stepT) (string, bool, error) {
+	action, err := step.action()
+	if err != nil {
+		return "", false, err
+	}
+	if err := step.check(action); err != nil {
+		return "", false, err
+	}
+	conn := r.Session.Conn
+	switch action {
+	case "scpi":
+		return "", true, send(conn, step.SCPI)
+
+	case "query":
+		value, err := command(conn, step.Query)
+		if err != nil {
+			return "", false, err
+		}
+		r.Variables[step.Into] = value
+		return value, true, nil
+
+	case "set":
+		for name, value := range step.Set {
+			r.Variables[name] = value
+		}
+		return "", true, nil
+
+	case "wait":
+		duration, _ := time.ParseDuration(step.Wait)
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+		return "", true, nil
+
+	case "wait_trigger":
+		var timeout time.Duration
+		if step.WaitTrigger.Timeout != "" {
+			timeout, _ = time.ParseDuration(step.WaitTrigger.Timeout)
+		}
+		return "", true, waitForTrigger(ctx, r.Session, step.WaitTrigger.Single, timeout)
+
+	case "prompt":
+		response, err := r.prompt(ctx, step.Prompt)
+		if err != nil {
+			return "", false, err
+		}
+		if step.Into != "" {
+			r.Variables[step.Into] = response
+			return response, true, nil
+		}
+		return "", true, nil
+
+	case "recipe":
+		recipe, err := loadRecipe(step.Recipe)
+		if err != nil {
+			return "", false, err
+		}
+		mismatches, err := recipe.apply(conn)
+		if err != nil {
+			return "", false, err
+		}
+		// Later captures record the measurements the recipe put on screen
+		r.Options.Measurements = recipe.withMeasurements(r.Options.Measurements)
+		if mismatches > 0 {
+			return fmt.Sprintf("%d mismatch(es)", mismatches), true, nil
+		}
+		return "", true, nil
+
+	case "capture":
+		options := r.Options
+		options.Note, options.Filename, options.Waveforms = step.Capture.Note, step.Capture.File, step.Capture.Waveforms
+		// The step's labels replace the scope's own
+		labels, _ := step.Capture.labels()
+		options.Labels = replaceLabels(config.Labels, nil, labels)
+		if options.FileType, err = selectFormat(r.Format, filenameTemplate(options.Filename, options.Note)); err != nil {
+			return "", false, err
+		}
+		record, err := captureOnce(r.Session, options)
+		if err != nil {
+			return "", false, err
+		}
+		r.Variables["last_capture"] = record.Path
+		return record.Path, true, nil
+
+	case "export":
+		return r.export(step.Export)
+
+	case "assert":
+		value, valid, err := queryMeasurement(conn, step.Assert.Measurement)
+		if err != nil {
+			return "", false, err
+		}
+		if !valid {
+			return "no valid value", false, nil
+		}
+		formatted := strconv.FormatFloat(value, 'g', 6, 64)
+		if step.Into != "" {
+			r.Variables[step.Into] = formatted
+		}
+		low, high, _ := step.Assert.limits()
+		limits := []string{}
+		if step.Assert.Min != "" {
+			limits = append(limits, "min "+step.Assert.Min)
+		}
+		if step.Assert.Max != "" {
+			limits = append(limits, "max "+step.Assert.Max)
+		}
+		detail := formatted
+		if len(limits) > 0 {
+			detail += " (" + strings.Join(limits, ", ") + ")"
+		}
+		return detail, value >= low && value <= high, nil
+	}
+	return "", false, fmt.Errorf("unknown action %q", action)
+}
+
+// prompt shows text to the operator and waits for them to press Enter, returning anything they
+// typed first.
+func (r *procedureRunnerT) prompt(ctx context.Context, text string) (string, error) {
+	fmt.Fprintf(console, "\n>>> %s\n    Press Enter to continue: ", text)
+	type responseT struct {
+		line string
+		err  error
+	}
+	responses := make(chan responseT, 1)
+	go func() {
+		line, err := r.Input.ReadString('\n')
+		responses <- responseT{line, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case response := <-responses:
+		if response.err != nil && response.line == "" {
+			return "", fmt.Errorf("no response to the prompt (standard input is closed)")
+		}
+		return strings.TrimSpace(response.line), nil
+	}
+}
+
+// export saves waveforms as CSV in the output directory.
+func (r *procedureRunnerT) export(export *exportStepT) (string, bool, error) {
+	sources, err := export.sources()
+	if err != nil {
+		return "", false, err
+	}
+	if len(sources) == 0 {
+		settings, err := querySettings(r.Session.Conn)
+		if err != nil {
+			return "", false, err
+		}
+		if sources = displayedChannels(settings); len(sources) == 0 {
+			return "", false, fmt.Errorf("no channels are displayed")
+		}
+	}
+	waveforms, err := readWaveforms(r.Session.Conn, sources)
+	if err != nil {
+		return "", false, err
+	}
+
+	ctx := templateContextT{
+		Time:       time.Now(),
+		Instrument: r.Session.Instrument,
+		Project:    config.Project,
+		Ext:        "csv",
+		Query:      r.Session.command,
+	}
+	file := export.File
+	if file == "" {
+		file = defaultExportFile
+	}
+	filename, err := expandTemplate(file, ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to build export filename: %w", err)
+	}
+	dir, err := resolveOutputDir(r.Options.OutputDir, ctx)
+	if err != nil {
+		return "", false, err
+	}
+	path, err := allocateOutputFile(filepath.Join(dir, filename), 1)
+	if err != nil {
+		return "", false, err
+	}
+	if err := writeFileAtomic(path, waveformCSV(waveforms)); err != nil {
+		os.Remove(path)
+		return "", false, err
+	}
+	log.InfoPrintf("Wrote waveforms to %q.", path)
+	return path, true, nil
+}
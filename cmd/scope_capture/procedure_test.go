@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadProcedure(t *testing.T) {
+	start := time.Date(2025, 1, 16, 19, 24, 33, 0, time.Local)
+	tests := []struct {
+		name      string
+		file      string
+		procedure string
+		overrides map[string]string
+		ok        bool
+	}{
+		{"valid", "p.json", `{"variables": {"board": "A1", "delay": "1s"}, "steps": [
+			{"scpi": ":RUN"},
+			{"wait": "${delay}"},
+			{"query": ":MEAS:ITEM? VPP,CHAN1", "into": "vpp"},
+			{"capture": {"note": "${board} ${serial} ${vpp} ${date}", "labels": {"CH1": "Vin"}}},
+			{"assert": {"measurement": "VPP CH1", "min": "1.8V", "max": "3.6V"}, "into": "measured"},
+			{"prompt": "Saved ${last_capture} with ${measured}"}]}`, nil, true},
+		{"override", "p.json", `{"variables": {"delay": "1s"}, "steps": [{"wait": "${delay}"}]}`,
+			map[string]string{"delay": "2s"}, true},
+		{"yaml", "p.yaml", "variables:\n  board: A1\nsteps:\n  - scpi: ':RUN'\n  - capture:\n      note: ${board}\n", nil, true},
+		// Variables set when the procedure runs are only checked then
+		{"dynamic", "p.json", `{"steps": [{"set": {"delay": "soon"}}, {"wait": "${delay}"}]}`, nil, true},
+
+		{"not JSON", "p.json", `steps: []`, nil, false},
+		{"unknown field", "p.json", `{"steps": [{"scpi": ":RUN", "waitt": "1s"}]}`, nil, false},
+		{"no steps", "p.json", `{"steps": []}`, nil, false},
+		{"no action", "p.json", `{"steps": [{"name": "nothing"}]}`, nil, false},
+		{"two actions", "p.json", `{"steps": [{"scpi": ":RUN", "wait": "1s"}]}`, nil, false},
+		{"query without into", "p.json", `{"steps": [{"query": "*IDN?"}]}`, nil, false},
+		{"into on scpi", "p.json", `{"steps": [{"scpi": ":RUN", "into": "x"}]}`, nil, false},
+		{"bad into", "p.json", `{"steps": [{"query": "*IDN?", "into": "1x"}]}`, nil, false},
+		{"bad variable name", "p.json", `{"variables": {"a-b": "1"}, "steps": [{"scpi": ":RUN"}]}`, nil, false},
+		{"bad set name", "p.json", `{"steps": [{"set": {"a b": "1"}}]}`, nil, false},
+		{"undefined override", "p.json", `{"steps": [{"scpi": ":RUN"}]}`, map[string]string{"board": "A1"}, false},
+		{"undefined variable", "p.json", `{"steps": [{"scpi": ":CHAN${n}:DISP 1"}]}`, nil, false},
+		{"used before set", "p.json", `{"steps": [{"wait": "${delay}"}, {"set": {"delay": "1s"}}]}`, nil, false},
+		{"scpi query", "p.json", `{"steps": [{"scpi": "*IDN?"}]}`, nil, false},
+		{"bad wait", "p.json", `{"variables": {"delay": "soon"}, "steps": [{"wait": "${delay}"}]}`, nil, false},
+		{"bad timeout", "p.json", `{"steps": [{"wait_trigger": {"timeout": "never"}}]}`, nil, false},
+		{"bad label", "p.json", `{"steps": [{"capture": {"labels": {"CH9": "x"}}}]}`, nil, false},
+		{"bad measurement", "p.json", `{"steps": [{"assert": {"measurement": "VPP"}}]}`, nil, false},
+		{"bad measurement source", "p.json", `{"steps": [{"assert": {"measurement": "VPP D0"}}]}`, nil, false},
+		{"bad limit", "p.json", `{"steps": [{"assert": {"measurement": "VPP CH1", "min": "low"}}]}`, nil, false},
+		{"missing recipe", "p.json", `{"steps": [{"recipe": "missing.json"}]}`, nil, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), test.file)
+		if err := os.WriteFile(path, []byte(test.procedure), 0644); err != nil {
+			t.Fatal(err)
+		}
+		procedure, err := loadProcedure(path, test.overrides, start)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: loadProcedure() error = %v; want ok %v", test.name, err, test.ok)
+		}
+		if err != nil {
+			continue
+		}
+		if procedure.Name != path || procedure.Variables["date"] != "2025-01-16" || procedure.Variables["time"] != "19-24-33" {
+			t.Errorf("%s: loadProcedure() = name %q, variables %v", test.name, procedure.Name, procedure.Variables)
+		}
+		for name, value := range test.overrides {
+			if procedure.Variables[name] != value {
+				t.Errorf("%s: variable %s = %q; want %q", test.name, name, procedure.Variables[name], value)
+			}
+		}
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{"board": "A1", "n": "2", "empty": ""}
+	tests := []struct {
+		text string
+		want string
+		ok   bool
+	}{
+		{"no variables", "no variables", true},
+		{"${board}", "A1", true},
+		{":CHAN${n}:SCAL 1;:CHAN${n}:DISP 1", ":CHAN2:SCAL 1;:CHAN2:DISP 1", true},
+		{"[${empty}]", "[]", true},
+		{"$board {board} $${board}", "$board {board} $A1", true},
+		{"${board", "${board", true},
+		{"${serial}", "", false},
+		{"${board} ${}", "", false},
+	}
+	for _, test := range tests {
+		got, err := expandVariables(test.text, variables)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("expandVariables(%q) = %q, %v; want %q (ok %v)", test.text, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestVariablesFlag(t *testing.T) {
+	var flag variablesFlag
+	for _, value := range []string{"board=A1", "note=a=b", "empty="} {
+		if err := flag.Set(value); err != nil {
+			t.Errorf("Set(%q) = %v", value, err)
+		}
+	}
+	want := variablesFlag{"board": "A1", "note": "a=b", "empty": ""}
+	if !reflect.DeepEqual(flag, want) {
+		t.Errorf("variablesFlag = %v; want %v", flag, want)
+	}
+	for _, value := range []string{"board", "=A1", "1x=2", "a b=c"} {
+		if err := flag.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded", value)
+		}
+	}
+}
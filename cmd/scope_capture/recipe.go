@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recipeT puts the scope into a known state before capturing.
+type recipeT struct {
+	// Name is the recipe file's name, recorded with each capture
+	Name string `json:"-"`
+	// Settings are keyed as the recorded capture settings (e.g. "ch1_scale", "timebase"), plus
+	// the recipe-only settings (e.g. "ch1_display", "trigger_slope")
+	Settings map[string]string `json:"settings"`
+	// Measurements are shown on screen, e.g. "FREQ CH1" or "VPP CH2"
+	Measurements []string `json:"measurements"`
+	// Commands are sent as is (after the settings, and without being verified)
+	Commands []string `json:"commands"`
+}
+
+// unitOnOff is the Unit of on/off settings, which the scope reports as 1 or 0.
+const unitOnOff = "on/off"
+
+var (
+	// recipeGlobalSettings are the global settings which may be set by a recipe, in the order in
+	// which they are applied. (The sample rate depends on the timebase, so isn't set directly.)
+	recipeGlobalSettings = []settingT{
+		{Key: "timebase", SCPI: ":TIM:MAIN:SCAL?", Unit: "s"},
+		{Key: "timebase_offset", SCPI: ":TIM:MAIN:OFFS?", Unit: "s"},
+		{Key: "trigger_mode", SCPI: ":TRIG:MODE?"},
+		{Key: "trigger_source", SCPI: ":TRIG:EDG:SOUR?"},
+		{Key: "trigger_slope", SCPI: ":TRIG:EDG:SLOP?"},
+		{Key: "trigger_level", SCPI: ":TRIG:EDG:LEV?", Unit: "V"},
+		{Key: "trigger_sweep", SCPI: ":TRIG:SWE?"},
+	}
+	// recipeChannelSettings are the channel settings which may be set by a recipe, in the order in
+	// which they are applied. %d is the channel number. The probe ratio comes before the scale and
+	// offset, because changing it changes them.
+	recipeChannelSettings = []settingT{
+		{Key: "ch%d_display", SCPI: ":CHAN%d:DISP?", Unit: unitOnOff},
+		{Key: "ch%d_probe", SCPI: ":CHAN%d:PROB?", Unit: "x"},
+		{Key: "ch%d_coupling", SCPI: ":CHAN%d:COUP?"},
+		{Key: "ch%d_scale", SCPI: ":CHAN%d:SCAL?", Unit: "V"},
+		{Key: "ch%d_offset", SCPI: ":CHAN%d:OFFS?", Unit: "V"},
+	}
+)
+
+// loadRecipe reads and checks a recipe file (JSON, or YAML if it has a .yaml or .yml extension).
+func loadRecipe(path string) (*recipeT, error) {
+	data, err := readDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recipe := &recipeT{}
+	if err := json.Unmarshal(data, recipe); err != nil {
+		return nil, fmt.Errorf("failed to parse recipe %q: %v", path, err)
+	}
+	recipe.Name = path
+	known := map[string]bool{}
+	for _, setting := range recipe.orderedSettings() {
+		known[setting.Key] = true
+	}
+	for key := range recipe.Settings {
+		if !known[key] {
+			return nil, fmt.Errorf("unknown setting %q in recipe %q (expected one of %s)", key, path, recipeKeys())
+		}
+	}
+	for i, measurement := range recipe.Measurements {
+		if recipe.Measurements[i], err = canonicalMeasurement(measurement); err != nil {
+			return nil, fmt.Errorf("%v in recipe %q", err, path)
+		}
+	}
+	return recipe, nil
+}
+
+// withMeasurements returns the measurements to record with each capture: those given, plus the
+// recipe's (if there is one).
+func (r *recipeT) withMeasurements(measurements []string) []string {
+	if r == nil {
+		return measurements
+	}
+	all := append([]string{}, measurements...)
+	for _, measurement := range r.Measurements {
+		all = appendMeasurement(all, measurement)
+	}
+	return all
+}
+
+// orderedSettings returns every setting a recipe may set, in the order in which they are applied.
+func (r *recipeT) orderedSettings() []settingT {
+	settings := []settingT{}
+	for channel := 1; channel <= maxAnalogChannel; channel++ {
+		for _, setting := range recipeChannelSettings {
+			settings = append(settings, settingT{Key: fmt.Sprintf(setting.Key, channel),
+				SCPI: fmt.Sprintf(setting.SCPI, channel), Unit: setting.Unit})
+		}
+	}
+	return append(settings, recipeGlobalSettings...)
+}
+
+// apply sends the recipe to the scope, then reads each setting back and reports those which
+// don't match (e.g. because the scope rounded a value to one it supports). It returns the number
+// of mismatches.
+func (r *recipeT) apply(conn net.Conn) (int, error) {
+	log.InfoPrintf("Applying recipe %q...", r.Name)
+	mismatches := 0
+	for _, setting := range r.orderedSettings() {
+		requested, ok := r.Settings[setting.Key]
+		if !ok {
+			continue
+		}
+		value, err := recipeValue(setting, requested)
+		if err != nil {
+			return mismatches, fmt.Errorf("recipe setting %s: %v", setting.Key, err)
+		}
+		if err := send(conn, strings.TrimSuffix(setting.SCPI, "?")+" "+value); err != nil {
+			return mismatches, err
+		}
+		actual, err := command(conn, setting.SCPI)
+		if err != nil {
+			return mismatches, err
+		}
+		if !settingMatches(setting, value, actual) {
+			log.InfoPrintf("WARNING: Recipe setting %s is %q, but the scope reports %q.", setting.Key, requested,
+				formatRecipeValue(setting, actual))
+			mismatches++
+		}
+	}
+	for _, scpi := range r.Commands {
+		if err := send(conn, scpi); err != nil {
+			return mismatches, err
+		}
+	}
+	if len(r.Measurements) > 0 {
+		if err := send(conn, ":MEAS:CLE ALL"); err != nil {
+			return mismatches, err
+		}
+	}
+	for _, measurement := range r.Measurements {
+		scpi, _ := measurementSCPI(measurement)
+		if err := send(conn, ":MEAS:ITEM "+scpi); err != nil {
+			return mismatches, err
+		}
+		number, valid, err := queryMeasurement(conn, measurement)
+		if err != nil {
+			return mismatches, err
+		}
+		if !valid {
+			log.InfoPrintf("WARNING: Recipe measurement %q has no valid value.", measurement)
+			mismatches++
+			continue
+		}
+		log.InfoPrintf("    %s: %s", measurement, strconv.FormatFloat(number, 'g', 6, 64))
+	}
+	if mismatches == 0 {
+		log.InfoPrint("    Recipe applied and verified.")
+	}
+	return mismatches, nil
+}
+
+// recipeValue converts a recipe value to the form sent to the scope, e.g. "500us" -> "0.0005",
+// "on" -> "1", "CH2" -> "CHAN2".
+func recipeValue(setting settingT, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch setting.Unit {
+	case "":
+		if source, err := canonicalSource(value); err == nil && strings.HasPrefix(source, "CH") {
+			return "CHAN" + strings.TrimPrefix(source, "CH"), nil
+		}
+		return strings.ToUpper(value), nil
+	case unitOnOff:
+		switch strings.ToUpper(value) {
+		case "1", "ON", "TRUE":
+			return "1", nil
+		case "0", "OFF", "FALSE":
+			return "0", nil
+		}
+		return "", fmt.Errorf("expected on or off, not %q", value)
+	}
+	number, err := parseSI(value, setting.Unit)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(number, 'g', -1, 64), nil
+}
+
+// settingMatches returns whether the scope's response to a setting query matches the value sent.
+// Numbers match if they are (almost) equal, and names if one is an abbreviation of the other
+// (the scope responds with abbreviations, e.g. "POS" for "POSitive").
+func settingMatches(setting settingT, sent, actual string) bool {
+	actual = strings.ToUpper(strings.TrimSpace(actual))
+	if setting.Unit != "" && setting.Unit != unitOnOff {
+		want, err1 := strconv.ParseFloat(sent, 64)
+		got, err2 := strconv.ParseFloat(actual, 64)
+		return err1 == nil && err2 == nil && math.Abs(got-want) <= 1e-6*max(math.Abs(want), 1e-12)
+	}
+	return actual != "" && (strings.HasPrefix(sent, actual) || strings.HasPrefix(actual, sent))
+}
+
+// formatRecipeValue formats a setting query response for display.
+func formatRecipeValue(setting settingT, value string) string {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if setting.Unit == "" || setting.Unit == unitOnOff || err != nil {
+		return value
+	}
+	return formatSI(number, setting.Unit)
+}
+
+// recipeKeys returns the settings keys a recipe may use, for error messages and documentation.
+func recipeKeys() string {
+	keys := []string{}
+	for _, setting := range recipeChannelSettings {
+		keys = append(keys, strings.Replace(setting.Key, "%d", "N", 1))
+	}
+	for _, setting := range recipeGlobalSettings {
+		keys = append(keys, setting.Key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestRecipeValue(t *testing.T) {
+	var (
+		name    = settingT{Key: "trigger_slope"}
+		onOff   = settingT{Key: "ch1_display", Unit: unitOnOff}
+		seconds = settingT{Key: "timebase", Unit: "s"}
+		volts   = settingT{Key: "ch1_offset", Unit: "V"}
+		probe   = settingT{Key: "ch1_probe", Unit: "x"}
+	)
+	tests := []struct {
+		setting settingT
+		value   string
+		want    string
+		ok      bool
+	}{
+		{name, "pos", "POS", true},
+		{name, " Negative ", "NEGATIVE", true},
+		{name, "ch2", "CHAN2", true},
+		{name, "CHAN3", "CHAN3", true},
+		{name, "ac", "AC", true},
+		{onOff, "on", "1", true},
+		{onOff, "True", "1", true},
+		{onOff, "OFF", "0", true},
+		{onOff, "0", "0", true},
+		{onOff, "maybe", "", false},
+		{seconds, "500us", "0.0005", true},
+		{seconds, "1ms", "0.001", true},
+		{seconds, "2", "2", true},
+		{seconds, "1e-6", "1e-06", true},
+		{seconds, "fast", "", false},
+		{volts, "-1.5V", "-1.5", true},
+		{volts, "200mV", "0.2", true},
+		{volts, "1A", "", false},
+		{probe, "10x", "10", true},
+	}
+	for _, test := range tests {
+		got, err := recipeValue(test.setting, test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("recipeValue(%s, %q) = %q, %v; want %q (ok %v)",
+				test.setting.Key, test.value, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestSettingMatches(t *testing.T) {
+	var (
+		name    = settingT{Key: "trigger_slope"}
+		onOff   = settingT{Key: "ch1_display", Unit: unitOnOff}
+		seconds = settingT{Key: "timebase", Unit: "s"}
+	)
+	tests := []struct {
+		setting      settingT
+		sent, actual string
+		want         bool
+	}{
+		// The scope responds with abbreviations
+		{name, "POSITIVE", "POS\n", true},
+		{name, "POS", "POSitive", true},
+		{name, "CHAN2", "CHAN2", true},
+		{name, "CHAN2", "CHAN1", false},
+		{name, "NEG", "POS", false},
+		{name, "POS", "", false},
+		{onOff, "1", "1", true},
+		{onOff, "1", "0", false},
+		{seconds, "0.0005", "5.000000e-04", true},
+		{seconds, "0.0005", "5.0000001e-04", true},
+		{seconds, "0.0005", "1.000000e-03", false},
+		{seconds, "0", "0.000000e+00", true},
+		{seconds, "0", "1e-9", false},
+		{seconds, "0.0005", "error", false},
+	}
+	for _, test := range tests {
+		if got := settingMatches(test.setting, test.sent, test.actual); got != test.want {
+			t.Errorf("settingMatches(%s, %q, %q) = %v; want %v",
+				test.setting.Key, test.sent, test.actual, got, test.want)
+		}
+	}
+}
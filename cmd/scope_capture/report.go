@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	reportMargin     = 40.0
+	reportBodySize   = 10.0
+	reportLineHeight = 13.0
+)
+
+// reportT is the content of a report, shared by the Markdown and PDF renderers.
+type reportT struct {
+	Title     string
+	Operator  string
+	Host      string
+	Version   string
+	Generated time.Time
+	// Captures have absolute paths
+	Captures []captureRecordT
+}
+
+func runReport(args []string) error {
+	var q indexQueryFlagsT
+	var flagGlob, flagOut, flagTitle, flagOperator string
+	fs := newSubcommandFlagSet("report", "")
+	q.register(fs)
+	fs.StringVar(&flagGlob, "glob", "",
+		"Report on the captures matching this file pattern (e.g. \"scope_captures/*.png\") instead of querying the index")
+	fs.StringVar(&flagOut, "o", "",
+		"Output path, without extension; \".md\" and \".pdf\" are appended (Defaults to report_{date}_{time} in the index directory)")
+	fs.StringVar(&flagTitle, "title", "Scope capture report", "Report title")
+	fs.StringVar(&flagOperator, "operator", "", "Operator name (Defaults to the current user)")
+	if positional := parseInterspersed(fs, args); len(positional) > 0 {
+		return fmt.Errorf("unexpected argument %q", positional[0])
+	}
+	if err := startup(); err != nil {
+		return err
+	}
+
+	var captures []captureRecordT
+	var err error
+	if flagGlob != "" {
+		captures, err = capturesFromGlob(flagGlob)
+	} else {
+		captures, err = capturesFromIndex(q)
+	}
+	if err != nil {
+		return err
+	}
+	if len(captures) == 0 {
+		return fmt.Errorf("no captures selected")
+	}
+	log.InfoPrintf("Reporting on %d capture(s).", len(captures))
+
+	report := reportT{
+		Title:     flagTitle,
+		Operator:  flagOperator,
+		Host:      config.Hostname,
+		Version:   versionInfo(),
+		Generated: time.Now(),
+		Captures:  captures,
+	}
+	if report.Operator == "" {
+		report.Operator = currentUser()
+	}
+
+	if flagOut == "" {
+		indexDir, err := indexDirForOutputDir(outputDirTemplate(q.outputDir))
+		if err != nil {
+			return err
+		}
+		flagOut = filepath.Join(indexDir, "report_"+report.Generated.Format("2006-01-02_15-04-05"))
+	}
+	if err := os.MkdirAll(filepath.Dir(flagOut), os.ModePerm); err != nil {
+		return err
+	}
+
+	markdownPath := flagOut + ".md"
+	if err := writeFileAtomic(markdownPath, []byte(report.markdown(filepath.Dir(markdownPath)))); err != nil {
+		return err
+	}
+	log.InfoPrintf("Wrote %q.", markdownPath)
+
+	pdfData, err := report.pdf()
+	if err != nil {
+		return err
+	}
+	pdfPath := flagOut + ".pdf"
+	if err := writeFileAtomic(pdfPath, pdfData); err != nil {
+		return err
+	}
+	log.InfoPrintf("Wrote %q.", pdfPath)
+	return nil
+}
+
+// capturesFromIndex selects captures from the index. If no selection options were given then
+// the most recent session is used.
+func capturesFromIndex(q indexQueryFlagsT) ([]captureRecordT, error) {
+	useLatestSession := q == indexQueryFlagsT{outputDir: q.outputDir}
+	records, indexDir, err := q.query()
+	if err != nil {
+		return nil, err
+	}
+	if useLatestSession && len(records) > 0 {
+		session := records[len(records)-1].Session
+		log.InfoPrintf("No captures selected, so using the most recent session (%s).", session)
+		latest := []captureRecordT{}
+		for _, record := range records {
+			if record.Session == session {
+				latest = append(latest, record)
+			}
+		}
+		records = latest
+	}
+	for i := range records {
+		records[i].Path = filepath.Join(indexDir, filepath.FromSlash(records[i].Path))
+	}
+	return records, nil
+}
+
+// capturesFromGlob selects the captures matching a file pattern, reading their embedded
+// metadata.
+func capturesFromGlob(pattern string) ([]captureRecordT, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	records := []captureRecordT{}
+	for _, path := range paths {
+		if !isCaptureImage(filepath.Base(path)) {
+			continue
+		}
+		record, ok, err := readCaptureMetadata(path)
+		if err != nil {
+			log.InfoPrintf("WARNING: Unable to read metadata from %q: %v", path, err)
+		}
+		if record.Kind != "" || isVariant(record, path) {
+			// A variant of a capture, or derived from captures (e.g. a comparison), so not a
+			// capture itself
+			continue
+		}
+		if !ok {
+			if info, err := os.Stat(path); err == nil {
+				record.Time = info.ModTime()
+			}
+		}
+		record.Path = path
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// currentUser returns the login name of the current user, if known.
+func currentUser() string {
+	for _, name := range []string{"USER", "USERNAME", "LOGNAME"} {
+		if user := os.Getenv(name); user != "" {
+			return user
+		}
+	}
+	return "(unknown)"
+}
+
+// captureTitle returns the heading for a capture: its note, or its filename if it has none.
+func captureTitle(record captureRecordT) string {
+	if record.Note != "" {
+		return record.Note
+	}
+	return filepath.Base(record.Path)
+}
+
+// captureDetails returns the name/value pairs describing a capture, in display order.
+func captureDetails(record captureRecordT) [][2]string {
+	details := [][2]string{
+		{"File", filepath.Base(record.Path)},
+		{"Time", record.Time.Local().Format("2006-01-02 15:04:05")},
+	}
+	if record.Instrument.Model != "" {
+		details = append(details, [2]string{"Instrument", strings.TrimSpace(fmt.Sprintf("%s %s %s (firmware %s)",
+			record.Instrument.Manufacturer, record.Instrument.Model, record.Instrument.Serial, record.Instrument.Firmware))})
+	}
+	if record.Project != "" {
+		details = append(details, [2]string{"Project", record.Project})
+	}
+	if record.Session != "" {
+		details = append(details, [2]string{"Session", record.Session})
+	}
+	return details
+}
+
+// sortedSettings returns a capture's settings as formatted name/value pairs.
+func sortedSettings(settings map[string]string) [][2]string {
+	keys := []string{}
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := [][2]string{}
+	for _, key := range keys {
+		pairs = append(pairs, [2]string{key, formatSetting(key, settings[key])})
+	}
+	return pairs
+}
+
+// measurementRows returns a capture's measurements as name/value pairs.
+func measurementRows(measurements []measurementT) [][2]string {
+	rows := [][2]string{}
+	for _, measurement := range measurements {
+		rows = append(rows, [2]string{measurement.Name, measurement.formatValue()})
+	}
+	return rows
+}
+
+func (r reportT) headerDetails() [][2]string {
+	return [][2]string{
+		{"Operator", r.Operator},
+		{"Host", r.Host},
+		{"Tool", r.Version},
+		{"Generated", r.Generated.Format("2006-01-02 15:04:05")},
+		{"Captures", fmt.Sprintf("%d", len(r.Captures))},
+	}
+}
+
+// markdown renders the report as Markdown. Image links are relative to dir.
+func (r reportT) markdown(dir string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", r.Title)
+	for _, detail := range r.headerDetails() {
+		fmt.Fprintf(&b, "- **%s:** %s\n", detail[0], detail[1])
+	}
+	for i, record := range r.Captures {
+		fmt.Fprintf(&b, "\n## %d. %s\n\n", i+1, captureTitle(record))
+		imagePath := record.Path
+		if relPath, err := filepath.Rel(dir, record.Path); err == nil {
+			imagePath = relPath
+		}
+		fmt.Fprintf(&b, "![%s](%s)\n\n", captureTitle(record), filepath.ToSlash(imagePath))
+		for _, detail := range captureDetails(record) {
+			fmt.Fprintf(&b, "- **%s:** %s\n", detail[0], detail[1])
+		}
+		if len(record.Labels) > 0 {
+			b.WriteString("\n| Source | Label |\n| --- | --- |\n")
+			for _, label := range record.Labels {
+				fmt.Fprintf(&b, "| %s | %s |\n", label.Source, markdownCell(label.Text))
+			}
+		}
+		if len(record.Measurements) > 0 {
+			b.WriteString("\n| Measurement | Value |\n| --- | --- |\n")
+			for _, measurement := range record.Measurements {
+				fmt.Fprintf(&b, "| %s | %s |\n", measurement.Name, measurement.formatValue())
+			}
+		}
+		if len(record.Settings) > 0 {
+			b.WriteString("\n| Setting | Value |\n| --- | --- |\n")
+			for _, setting := range sortedSettings(record.Settings) {
+				fmt.Fprintf(&b, "| %s | %s |\n", setting[0], markdownCell(setting[1]))
+			}
+		}
+	}
+	return b.String()
+}
+
+func markdownCell(text string) string {
+	return strings.ReplaceAll(text, "|", "\\|")
+}
+
+// reportLayoutT places content on successive PDF pages, top to bottom.
+type reportLayoutT struct {
+	doc  *pdfT
+	page *pdfPageT
+	y    float64
+}
+
+func (l *reportLayoutT) newPage() {
+	l.page = l.doc.addPage()
+	l.y = pdfPageHeight - reportMargin
+}
+
+// ensure starts a new page unless there are at least height points left on this one.
+func (l *reportLayoutT) ensure(height float64) {
+	if l.page == nil || l.y-height < reportMargin {
+		l.newPage()
+	}
+}
+
+// paragraph writes text, word wrapped to the page width.
+func (l *reportLayoutT) paragraph(text string, font pdfFontT, size float64) {
+	width := pdfPageWidth - 2*reportMargin
+	line := ""
+	flush := func() {
+		l.ensure(size * 1.3)
+		l.y -= size * 1.3
+		l.page.text(reportMargin, l.y, font, size, line)
+		line = ""
+	}
+	for _, word := range strings.Fields(text) {
+		candidate := strings.TrimSpace(line + " " + word)
+		if line != "" && pdfTextWidth(candidate, font, size) > width {
+			flush()
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" {
+		flush()
+	}
+}
+
+// table writes name/value rows, with the values aligned in a second column.
+func (l *reportLayoutT) table(rows [][2]string) {
+	nameWidth := 0.0
+	for _, row := range rows {
+		nameWidth = max(nameWidth, pdfTextWidth(row[0], pdfFontBold, reportBodySize))
+	}
+	for _, row := range rows {
+		l.ensure(reportLineHeight)
+		l.y -= reportLineHeight
+		l.page.text(reportMargin, l.y, pdfFontBold, reportBodySize, row[0])
+		l.page.text(reportMargin+nameWidth+10, l.y, pdfFontRegular, reportBodySize, row[1])
+	}
+}
+
+func (l *reportLayoutT) space(height float64) {
+	l.y -= height
+}
+
+// pdf renders the report as a self-contained PDF.
+func (r reportT) pdf() ([]byte, error) {
+	l := &reportLayoutT{doc: newPDF()}
+	l.newPage()
+	l.paragraph(r.Title, pdfFontBold, 20)
+	l.space(6)
+	l.table(r.headerDetails())
+
+	for i, record := range r.Captures {
+		img, err := decodeImageFile(record.Path)
+		if err != nil {
+			return nil, err
+		}
+		// Each capture starts on a new page, with its image scaled to the page width
+		l.newPage()
+		l.paragraph(fmt.Sprintf("%d. %s", i+1, captureTitle(record)), pdfFontBold, 14)
+		l.space(6)
+		width := pdfPageWidth - 2*reportMargin
+		height := width * float64(img.Bounds().Dy()) / float64(img.Bounds().Dx())
+		l.ensure(height)
+		l.y -= height
+		if err := l.doc.image(l.page, img, reportMargin, l.y, width, height); err != nil {
+			return nil, err
+		}
+		l.space(8)
+		l.table(captureDetails(record))
+		if len(record.Labels) > 0 {
+			l.space(6)
+			for _, label := range record.Labels {
+				l.ensure(reportLineHeight)
+				l.y -= reportLineHeight
+				r, g, b, _ := printableColor(sourceColor(label.Source)).RGBA()
+				l.page.textColor(reportMargin, l.y, pdfFontMono, reportBodySize, label.String(),
+					float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff)
+			}
+		}
+		if len(record.Measurements) > 0 {
+			l.space(6)
+			l.table(measurementRows(record.Measurements))
+		}
+		if len(record.Settings) > 0 {
+			l.space(6)
+			l.table(sortedSettings(record.Settings))
+		}
+	}
+	return l.doc.bytes(), nil
+}
+
+// decodeImageFile reads and decodes an image file.
+func decodeImageFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %v", path, err)
+	}
+	return img, nil
+}
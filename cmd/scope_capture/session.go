@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sessionT is an open connection to a scope. A session is kept open across captures so that
+// repeated captures don't pay for a ping and a new connection each time.
+type sessionT struct {
+	Hostname     string
+	Port         int
+	Conn         net.Conn
+	InstrumentID string
+	Instrument   instrumentT
+}
+
+// openSession pings the scope, connects to it and reads its instrument ID.
+func openSession(hostname string, port int) (*sessionT, error) {
+	session := &sessionT{Hostname: hostname, Port: port}
+	if err := session.connect(); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *sessionT) connect() error {
+	if err := testPing(s.Hostname, s.Port); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(s.Hostname, strconv.Itoa(s.Port)))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", s.Hostname, err)
+	}
+	s.Conn = conn
+
+	s.InstrumentID, err = command(conn, "*IDN?")
+	if err != nil {
+		s.Close()
+		return err
+	}
+	s.Instrument = parseInstrumentID(s.InstrumentID)
+	log.InfoPrintf("Instrument ID: %q.", s.InstrumentID)
+	return nil
+}
+
+// reconnect closes and reopens the connection, e.g. after a failed capture.
+func (s *sessionT) reconnect() error {
+	log.InfoPrintf("Reconnecting to %s...", s.Hostname)
+	s.Close()
+	return s.connect()
+}
+
+func (s *sessionT) Close() {
+	if s.Conn != nil {
+		s.Conn.Close()
+		s.Conn = nil
+	}
+}
+
+// command sends a SCPI command and returns the (single line) response.
+func (s *sessionT) command(scpi string) (string, error) {
+	return command(s.Conn, scpi)
+}
+
+// scopeT is a scope profile: a scope named in the config file's "scopes".
+type scopeT struct {
+	Hostname string `json:"hostname"`
+	// Port (optional) defaults to the config file's port
+	Port int `json:"port"`
+	// Transport (optional) is how to talk to the scope. Only "tcp" (raw SCPI over a TCP
+	// socket) is supported.
+	Transport string `json:"transport"`
+	// Labels (optional) are the scope's default labels, keyed by source, e.g. {"CH1": "Clock"}
+	Labels map[string]string `json:"labels"`
+	// Layout (optional) names the scope's screen layout (a key of layouts)
+	Layout string `json:"layout"`
+	// OutputDir (optional) replaces the config file's output directory
+	OutputDir string `json:"output_dir"`
+}
+
+// check checks a scope profile read from the config file.
+func (s scopeT) check() error {
+	if s.Hostname == "" {
+		return fmt.Errorf("no hostname")
+	}
+	if s.Transport != "" && strings.ToLower(s.Transport) != "tcp" {
+		return fmt.Errorf("unsupported transport %q (only \"tcp\" is supported)", s.Transport)
+	}
+	if _, ok := layouts[s.Layout]; s.Layout != "" && !ok {
+		return fmt.Errorf("unknown layout %q (expected one of %s)", s.Layout, layoutNames())
+	}
+	_, err := s.labels()
+	return err
+}
+
+// labels returns the scope's default labels, in scope order.
+func (s scopeT) labels() ([]labelT, error) {
+	labels := []labelT{}
+	for source, text := range s.Labels {
+		label, err := parseLabel(source + "=" + text)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return mergeLabels(nil, labels), nil
+}
+
+// scopeNames returns the names of the config file's scopes, for error messages.
+func scopeNames() string {
+	names := []string{}
+	for name := range config.Scopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// selectScope applies the scope profile named by -scope (or else the config file's
+// default_scope, if any) to the config: its hostname, port, output directory, layout and labels
+// replace the config file's.
+func selectScope(name string) error {
+	if name == "" {
+		name = config.DefaultScope
+	}
+	if name == "" {
+		return nil
+	}
+	scope, ok := config.Scopes[name]
+	if !ok {
+		return fmt.Errorf("unknown scope %q (expected one of %s)", name, scopeNames())
+	}
+	config.Scope = name
+	config.ScopeHostname = scope.Hostname
+	if scope.Port != 0 {
+		config.ScopePort = scope.Port
+	}
+	if scope.OutputDir != "" {
+		config.OutputDir = scope.OutputDir
+	}
+	if scope.Layout != "" {
+		config.Layout = scope.Layout
+	}
+	config.Labels, _ = scope.labels()
+	log.InfoPrintf("Using scope %q (%s:%d).", name, config.ScopeHostname, config.ScopePort)
+	return nil
+}
+
+// scopeFlagsT are the options subcommands which talk to the scope use to find it.
+type scopeFlagsT struct {
+	hostname string
+	port     int
+}
+
+func (f *scopeFlagsT) register(fs *flag.FlagSet) {
+	fs.StringVar(&flagScope, "scope", "", "Name of the scope profile (from the config file) to use (Defaults to the config file's default_scope)")
+	fs.StringVar(&f.hostname, "host", "", "Hostname or IP address of the oscilloscope (Defaults to the config file's)")
+	fs.IntVar(&f.port, "port", 0, "Port number of the oscilloscope (Defaults to the config file's)")
+}
+
+// open opens a session with the scope. The config file must have been loaded.
+func (f *scopeFlagsT) open() (*sessionT, error) {
+	hostname, port := config.ScopeHostname, config.ScopePort
+	if f.hostname != "" {
+		hostname = f.hostname
+	}
+	if f.port != 0 {
+		port = f.port
+	}
+	return openSession(hostname, port)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// settingT describes a scope setting recorded with each capture.
+type settingT struct {
+	Key  string
+	SCPI string
+	// Unit is used to format numeric values for display ("" for non-numeric settings, and
+	// unitOnOff for on/off settings)
+	Unit string
+}
+
+var (
+	// globalSettings are recorded for every capture.
+	globalSettings = []settingT{
+		{Key: "timebase", SCPI: ":TIM:MAIN:SCAL?", Unit: "s"},
+		{Key: "timebase_offset", SCPI: ":TIM:MAIN:OFFS?", Unit: "s"},
+		{Key: "sample_rate", SCPI: ":ACQ:SRAT?", Unit: "Sa/s"},
+		{Key: "trigger_mode", SCPI: ":TRIG:MODE?"},
+		{Key: "trigger_sweep", SCPI: ":TRIG:SWE?"},
+		{Key: "trigger_source", SCPI: ":TRIG:EDG:SOUR?"},
+		{Key: "trigger_level", SCPI: ":TRIG:EDG:LEV?", Unit: "V"},
+	}
+	// channelSettings are recorded for each displayed analog channel. %d is the channel number.
+	channelSettings = []settingT{
+		{Key: "ch%d_scale", SCPI: ":CHAN%d:SCAL?", Unit: "V"},
+		{Key: "ch%d_offset", SCPI: ":CHAN%d:OFFS?", Unit: "V"},
+		{Key: "ch%d_coupling", SCPI: ":CHAN%d:COUP?"},
+	}
+)
+
+// querySettings reads the settings which are recorded alongside each capture. Values are stored
+// exactly as the scope returned them; use formatSetting to display them.
+func querySettings(conn net.Conn) (map[string]string, error) {
+	log.InfoPrint("Reading scope settings...")
+	settings := map[string]string{}
+	for _, setting := range globalSettings {
+		value, err := command(conn, setting.SCPI)
+		if err != nil {
+			return nil, err
+		}
+		settings[setting.Key] = value
+	}
+	for channel := 1; channel <= maxAnalogChannel; channel++ {
+		displayed, err := command(conn, fmt.Sprintf(":CHAN%d:DISP?", channel))
+		if err != nil {
+			return nil, err
+		}
+		if displayed != "1" {
+			continue
+		}
+		for _, setting := range channelSettings {
+			value, err := command(conn, fmt.Sprintf(setting.SCPI, channel))
+			if err != nil {
+				return nil, err
+			}
+			settings[fmt.Sprintf(setting.Key, channel)] = value
+		}
+	}
+	return settings, nil
+}
+
+// settingUnit returns the display unit for a settings key ("" if it is not numeric).
+func settingUnit(key string) string {
+	for _, setting := range globalSettings {
+		if setting.Key == key {
+			return setting.Unit
+		}
+	}
+	for _, setting := range channelSettings {
+		var channel int
+		if _, err := fmt.Sscanf(key, setting.Key, &channel); err == nil &&
+			fmt.Sprintf(setting.Key, channel) == key {
+			return setting.Unit
+		}
+	}
+	return ""
+}
+
+// formatSetting formats a recorded setting for display, e.g. "5.000000e-04" -> "500us".
+func formatSetting(key, value string) string {
+	unit := settingUnit(key)
+	if unit == "" {
+		return value
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return value
+	}
+	return formatSI(number, unit)
+}
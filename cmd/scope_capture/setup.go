@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runSetup saves the scope's setup to a file, or loads (restores) it from a setup file or from a
+// capture made with -embed-setup.
+func runSetup(args []string) error {
+	var scope scopeFlagsT
+	fs := newSubcommandFlagSet("setup", "save|load FILE")
+	scope.register(fs)
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 2 || positional[0] != "save" && positional[0] != "load" {
+		fs.Usage()
+		return fmt.Errorf("expected \"save FILE\" or \"load FILE\"")
+	}
+	action, path := positional[0], positional[1]
+	if err := startup(); err != nil {
+		return err
+	}
+
+	// Read the setup to load before connecting, so a bad file doesn't touch the scope
+	var setup []byte
+	if action == "load" {
+		var err error
+		if setup, err = readSetup(path); err != nil {
+			return err
+		}
+	}
+	session, err := scope.open()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if action == "save" {
+		log.InfoPrint("Reading scope setup...")
+		setup, err := queryTMCBlock(session.Conn, ":SYST:SET?")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, setup); err != nil {
+			return err
+		}
+		log.InfoPrintf("Wrote %d byte setup to %q.", len(setup), path)
+		return nil
+	}
+	log.InfoPrintf("Loading %d byte setup...", len(setup))
+	if err := sendTMCBlock(session.Conn, ":SYST:SET", setup); err != nil {
+		return err
+	}
+	log.InfoPrintf("Loaded setup from %q.", path)
+	return nil
+}
+
+// readSetup reads a setup to load: either the setup embedded in a capture's metadata, or a setup
+// file (as written by "setup save", or by the scope itself).
+func readSetup(path string) ([]byte, error) {
+	record, ok, err := readCaptureMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if len(record.Setup) == 0 {
+			return nil, fmt.Errorf("%q has no embedded setup (capture with -embed-setup to embed one)", path)
+		}
+		log.InfoPrintf("Using the setup embedded in %q (captured %s).", path, record.Time.Format("2006-01-02 15:04:05"))
+		return record.Setup, nil
+	}
+	setup, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(setup) == 0 {
+		return nil, fmt.Errorf("%q is empty", path)
+	}
+	return setup, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subcommandT is a named mode of operation other than the default (capture the screen).
+type subcommandT struct {
+	// Usage is a one line summary shown by -help
+	Usage string
+	// Run parses the subcommand's arguments (everything after the subcommand name) and runs it
+	Run func(args []string) error
+}
+
+// subcommands is populated by init() so that subcommands may refer to it (e.g. for usage).
+var subcommands map[string]subcommandT
+
+func init() {
+	subcommands = map[string]subcommandT{
+		"animate":  {Usage: "Assemble a sequence of captures into an animated GIF or APNG", Run: runAnimate},
+		"annotate": {Usage: "Re-annotate an existing raw capture", Run: runAnnotate},
+		"check":    {Usage: "Capture the screen and check it against a golden image", Run: runCheck},
+		"compare":  {Usage: "Compare two captures side by side, overlaid or as a pixel diff", Run: runCompare},
+		"gallery":  {Usage: "Generate a static HTML gallery of the captures", Run: runGallery},
+		"list":     {Usage: "List the captures in the index", Run: runList},
+		"report":   {Usage: "Generate a Markdown and PDF report from a set of captures", Run: runReport},
+		"run":      {Usage: "Run a test procedure of SCPI, wait, prompt, capture, export and assert steps", Run: runProcedure},
+		"search":   {Usage: "Search the captures in the index", Run: runSearch},
+		"setup":    {Usage: "Save the scope's setup to a file, or load it from a file or capture", Run: runSetup},
+	}
+}
+
+// lookupSubcommand returns the subcommand named by the first command line argument, if any.
+func lookupSubcommand(args []string) (string, subcommandT, bool) {
+	if len(args) == 0 {
+		return "", subcommandT{}, false
+	}
+	subcommand, ok := subcommands[args[0]]
+	return args[0], subcommand, ok
+}
+
+// printSubcommandUsage lists the subcommands, for inclusion in -help output.
+func printSubcommandUsage() {
+	names := []string{}
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "\nSubcommands (run \"%s SUBCOMMAND -help\" for details):\n", config.AppName)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, subcommands[name].Usage)
+	}
+}
+
+// newSubcommandFlagSet returns a flag set for a subcommand with the options common to all
+// subcommands already registered.
+func newSubcommandFlagSet(name, positionalUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&flagDebug, "d", false, "Enable debug printing.")
+	fs.BoolVar(&flagDebug, "debug", false, "Enable debug printing.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s:\n  %s %s [options] %s\n",
+			config.AppName, name, config.AppName, name, positionalUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseInterspersed parses args with fs, allowing flags to follow positional arguments (e.g.
+// "annotate raw.png -n note"), and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		// Errors exit, since the flag set uses flag.ExitOnError
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...)
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runSubcommand runs a subcommand and exits.
+func runSubcommand(name string, subcommand subcommandT, args []string) {
+	if err := subcommand.Run(args); err != nil {
+		if log != nil {
+			log.ErrorPrintf("%s: %v", name, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", name, strings.TrimSpace(err.Error()))
+		}
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+)
+
+const defaultThemeName = "screen"
+
+// themeT controls the colors of an annotated capture.
+type themeT struct {
+	Name string
+	// ScopeInvert asks the scope for an inverted (white background) screenshot
+	ScopeInvert bool
+	// Recolor (if set) maps the color of every pixel of the screenshot before it is annotated
+	Recolor func(c color.RGBA) color.RGBA
+	// Annotation maps an annotation color (chosen for the scope's black background) to the
+	// color to draw it in
+	Annotation func(c color.Color) color.Color
+	// Background fills the erased areas behind annotations
+	Background color.Color
+}
+
+var themes = map[string]*themeT{
+	// The scope's own colors
+	"screen": {
+		Name:       "screen",
+		Annotation: func(c color.Color) color.Color { return c },
+		Background: color.Black,
+	},
+	// A software recolor for printing: white background, light grey grid and darkened traces
+	"print": {
+		Name:       "print",
+		Recolor:    printRecolor,
+		Annotation: printableColor,
+		Background: color.White,
+	},
+	// The scope's inverted screenshot, with annotations inverted to match
+	"invert": {
+		Name:        "invert",
+		ScopeInvert: true,
+		Annotation:  invertColor,
+		Background:  color.White,
+	},
+}
+
+// themeNames returns the names of the themes, for usage and error messages.
+func themeNames() string {
+	names := []string{}
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// lookupTheme returns the named theme ("" for the default).
+func lookupTheme(name string) (*themeT, error) {
+	if name == "" {
+		name = defaultThemeName
+	}
+	theme, ok := themes[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown theme %q (expected one of %s)", name, themeNames())
+	}
+	return theme, nil
+}
+
+// printRecolor maps a screenshot color for printing. Greys (the background, grid and text) are
+// inverted, so black becomes white and dark grey becomes light grey, while colors (the traces)
+// keep their hue and are darkened for contrast against white.
+func printRecolor(c color.RGBA) color.RGBA {
+	brightest := max(c.R, c.G, c.B)
+	darkest := min(c.R, c.G, c.B)
+	const minBrightness = 40
+	if brightest > minBrightness && int(brightest-darkest)*4 > int(brightest) {
+		return printableColor(c).(color.RGBA)
+	}
+	return color.RGBA{255 - c.R, 255 - c.G, 255 - c.B, c.A}
+}
+
+// printableColor darkens light (e.g. yellow) trace colors so that they are legible on white
+// paper, preserving their hue. Greys (e.g. the mono palette) are all darkened by the same factor
+// rather than each to the same limit, so that distinct shades stay distinct.
+func printableColor(c color.Color) color.Color {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	const maxComponent = 160
+	brightest := max(rgba.R, rgba.G, rgba.B)
+	darkest := min(rgba.R, rgba.G, rgba.B)
+	if int(brightest-darkest)*4 <= int(brightest) {
+		brightest = 255
+	} else if brightest <= maxComponent {
+		return rgba
+	}
+	scale := func(v uint8) uint8 { return uint8(int(v) * maxComponent / int(brightest)) }
+	return color.RGBA{scale(rgba.R), scale(rgba.G), scale(rgba.B), rgba.A}
+}
+
+func invertColor(c color.Color) color.Color {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	return color.RGBA{255 - rgba.R, 255 - rgba.G, 255 - rgba.B, rgba.A}
+}
+
+// recolorImage applies recolor to every pixel of img. Scope screens use few colors, so each
+// distinct color is only mapped once.
+func recolorImage(img *image.RGBA, recolor func(c color.RGBA) color.RGBA) {
+	mapped := map[color.RGBA]color.RGBA{}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		c := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+		to, ok := mapped[c]
+		if !ok {
+			to = recolor(c)
+			mapped[c] = to
+		}
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = to.R, to.G, to.B, to.A
+	}
+}
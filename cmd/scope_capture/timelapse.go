@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// timeLapseT holds the time-lapse (repeated capture) options.
+type timeLapseT struct {
+	Interval time.Duration
+	// Count (if non zero) limits the number of captures
+	Count int
+	// Duration (if non zero) limits how long to keep capturing
+	Duration time.Duration
+	// Retries is the number of attempts made at each capture before it is skipped
+	Retries int
+	// Animate (if set) is the path of an animated GIF or APNG assembled from the captures
+	Animate string
+}
+
+func (t timeLapseT) enabled() bool {
+	return t.Interval > 0 || t.Count > 0 || t.Duration > 0
+}
+
+// withSequenceNumber returns a filename template which contains {seq}, adding "_{seq}" before
+// the extension if necessary, so that time-lapse captures are numbered by shot.
+func withSequenceNumber(template string) string {
+	if strings.Contains(template, seqToken) {
+		return template
+	}
+	ext := filepath.Ext(template)
+	return strings.TrimSuffix(template, ext) + "_" + seqToken + ext
+}
+
+// runTimeLapse captures repeatedly over one session until the count or duration is reached or
+// the user presses Ctrl-C. A capture which fails is retried (reconnecting first); if it still
+// fails it is skipped and the time-lapse carries on.
+func runTimeLapse(session *sessionT, options captureOptionsT, timeLapse timeLapseT) error {
+	if timeLapse.Count == 0 && timeLapse.Duration == 0 {
+		return fmt.Errorf("-interval needs -count and/or -duration")
+	}
+	if timeLapse.Retries < 1 {
+		timeLapse.Retries = 1
+	}
+	options.Filename = withSequenceNumber(filenameTemplate(options.Filename, options.Note))
+	// The settings are read once rather than before every shot, which would slow each one down
+	if options.Settings == nil {
+		settings, err := querySettings(session.Conn)
+		if err != nil {
+			return err
+		}
+		options.Settings = settings
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	total := "?"
+	if timeLapse.Count > 0 {
+		total = fmt.Sprint(timeLapse.Count)
+	}
+	log.InfoPrintf("Starting time-lapse: every %v, count %s, duration %v. Press Ctrl-C to stop.",
+		timeLapse.Interval, total, timeLapse.Duration)
+
+	captured, failed := 0, 0
+	animation := animationT{Delay: defaultFrameDelay, Overlay: true}
+	for shot := 1; timeLapse.Count == 0 || shot <= timeLapse.Count; shot++ {
+		if timeLapse.Duration > 0 && time.Since(start) >= timeLapse.Duration {
+			break
+		}
+		var record captureRecordT
+		var err error
+		shotStart := time.Now()
+		// Number files by shot (where the template allows), so gaps show skipped captures
+		options.FirstSeq = shot
+		for attempt := 1; attempt <= timeLapse.Retries; attempt++ {
+			record, err = captureOnce(session, options)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			log.InfoPrintf("[%d/%s] Attempt %d/%d failed: %v", shot, total, attempt, timeLapse.Retries, err)
+			if attempt < timeLapse.Retries {
+				if err := session.reconnect(); err != nil {
+					log.InfoPrintf("[%d/%s] Reconnect failed: %v", shot, total, err)
+				}
+			}
+		}
+		if err == nil {
+			captured++
+			animation.Captures = append(animation.Captures, record)
+			log.InfoPrintf("[%d/%s] Captured %q in %v (elapsed %v).", shot, total, record.Path,
+				time.Since(shotStart).Round(time.Millisecond), time.Since(start).Round(time.Second))
+		} else {
+			failed++
+			log.ErrorPrintf("[%d/%s] Skipping capture: %v", shot, total, err)
+		}
+
+		if timeLapse.Count > 0 && shot >= timeLapse.Count {
+			break
+		}
+		// Wait until this shot's slot ends. Slots are measured from the start, so a slow
+		// capture doesn't delay all of the ones which follow it.
+		next := start.Add(time.Duration(shot) * timeLapse.Interval)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(next)):
+		}
+		if ctx.Err() != nil {
+			log.InfoPrint("Interrupted.")
+			break
+		}
+	}
+
+	log.InfoPrintf("Time-lapse finished: %d captured, %d failed, in %v.",
+		captured, failed, time.Since(start).Round(time.Second))
+	if captured == 0 && failed > 0 {
+		return fmt.Errorf("every capture failed")
+	}
+	if timeLapse.Animate != "" {
+		return animation.write(timeLapse.Animate)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+const (
+	triggerPollInterval = 100 * time.Millisecond
+	// After :SING the scope may still report STOP (from the previous acquisition) for a moment.
+	// A STOP seen within this time of arming only counts once the scope has reported any other
+	// status.
+	triggerArmGrace = 2 * time.Second
+)
+
+// triggerT holds the trigger-armed capture options.
+type triggerT struct {
+	// Single arms the scope with :SING before waiting
+	Single bool
+	// Wait waits for the scope to stop (i.e. to have triggered) before capturing
+	Wait bool
+	// Timeout (if non zero) limits how long to wait for each trigger
+	Timeout time.Duration
+	// Loop re-arms the scope after each capture, capturing every trigger event
+	Loop bool
+}
+
+func (t triggerT) enabled() bool {
+	return t.Single || t.Wait || t.Loop
+}
+
+var errTriggerTimeout = errors.New("timed out waiting for trigger")
+
+// waitForTrigger (optionally) arms the scope, then polls :TRIG:STAT? until it reports STOP.
+func waitForTrigger(ctx context.Context, session *sessionT, arm bool, timeout time.Duration) error {
+	armed := time.Now()
+	if arm {
+		log.InfoPrint("Arming single trigger...")
+		if err := send(session.Conn, ":SING"); err != nil {
+			return err
+		}
+	}
+	log.InfoPrint("Waiting for trigger. Press Ctrl-C to stop.")
+	seenRunning := !arm
+	for {
+		status, err := session.command(":TRIG:STAT?")
+		if err != nil {
+			return err
+		}
+		if status == "STOP" && (seenRunning || time.Since(armed) >= triggerArmGrace) {
+			log.InfoPrintf("    Triggered after %v.", time.Since(armed).Round(time.Millisecond))
+			return nil
+		}
+		if status != "STOP" {
+			seenRunning = true
+		}
+		if timeout > 0 && time.Since(armed) >= timeout {
+			return errTriggerTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(triggerPollInterval):
+		}
+	}
+}
+
+// runTriggered waits for a trigger and captures, repeating (if looping) until the count or
+// duration is reached or the user presses Ctrl-C. When looping, a trigger timeout just re-arms
+// the scope; otherwise it is an error.
+func runTriggered(session *sessionT, options captureOptionsT, trigger triggerT, limits timeLapseT) error {
+	if limits.Interval > 0 {
+		return fmt.Errorf("-interval can't be combined with trigger-armed capture")
+	}
+	if trigger.Loop {
+		options.Filename = withSequenceNumber(filenameTemplate(options.Filename, options.Note))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	captured := 0
+	for event := 1; ; event++ {
+		if limits.Duration > 0 && time.Since(start) >= limits.Duration {
+			break
+		}
+		// Every pass after the first re-arms the scope
+		arm := trigger.Single || event > 1
+		err := waitForTrigger(ctx, session, arm, trigger.Timeout)
+		if ctx.Err() != nil {
+			log.InfoPrint("Interrupted.")
+			break
+		}
+		if errors.Is(err, errTriggerTimeout) && trigger.Loop {
+			log.InfoPrintf("No trigger within %v; re-arming.", trigger.Timeout)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		options.FirstSeq = captured + 1
+		record, err := captureOnce(session, options)
+		if err != nil {
+			return err
+		}
+		captured++
+		if !trigger.Loop {
+			return nil
+		}
+		log.InfoPrintf("[%d] Captured %q (elapsed %v).", captured, record.Path, time.Since(start).Round(time.Second))
+		if limits.Count > 0 && captured >= limits.Count {
+			break
+		}
+	}
+	log.InfoPrintf("Trigger logging finished: %d captured in %v.", captured, time.Since(start).Round(time.Second))
+	return nil
+}
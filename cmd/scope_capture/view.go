@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const fullRegion = "full"
+
+// viewT selects the part of an annotated capture to output, and its size.
+type viewT struct {
+	// Region is "full" or one of the layout's Regions
+	Region string
+	Scale  float64
+	// Scaler is "auto" (nearest neighbor for whole number scales, otherwise smooth), "nearest"
+	// or "smooth"
+	Scaler string
+}
+
+var defaultView = viewT{Region: fullRegion, Scale: 1, Scaler: "auto"}
+
+// parseView parses a view specification of the form REGION[@SCALE], e.g. "graticule@2".
+func parseView(spec string) (viewT, error) {
+	view := defaultView
+	region, scale, hasScale := strings.Cut(spec, "@")
+	if region != "" {
+		view.Region = strings.ToLower(region)
+	}
+	if hasScale {
+		var err error
+		view.Scale, err = strconv.ParseFloat(strings.TrimSuffix(scale, "x"), 64)
+		if err != nil || view.Scale <= 0 {
+			return view, fmt.Errorf("invalid scale %q in %q", scale, spec)
+		}
+	}
+	return view, nil
+}
+
+// checkView returns an error if the view can't be applied to captures using the default layout.
+func checkView(view viewT) error {
+	if _, ok := layouts[defaultLayoutName].Regions[view.Region]; !ok && view.Region != fullRegion {
+		return fmt.Errorf("unknown region %q (expected one of %s)", view.Region, regionNames(layouts[defaultLayoutName]))
+	}
+	if view.Scale <= 0 {
+		return fmt.Errorf("scale must be positive")
+	}
+	switch view.Scaler {
+	case "auto", "nearest", "smooth":
+		return nil
+	}
+	return fmt.Errorf("unknown scaler %q (expected auto, nearest or smooth)", view.Scaler)
+}
+
+// regionNames returns the names of a layout's regions, for usage and error messages.
+func regionNames(layout *layoutT) string {
+	names := []string{fullRegion}
+	for name := range layout.Regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (v viewT) String() string {
+	return fmt.Sprintf("%s@%g", v.Region, v.Scale)
+}
+
+// apply crops and scales img, whose screen regions are given by layout.
+func (v viewT) apply(img image.Image, layout *layoutT) image.Image {
+	bounds := img.Bounds()
+	if v.Region != fullRegion {
+		region, ok := layout.Regions[v.Region]
+		if ok {
+			bounds = region.Intersect(bounds)
+		} else {
+			log.InfoPrintf("WARNING: Unknown region %q; using the full image.", v.Region)
+		}
+	}
+	if v.Scale == 1 {
+		if sub, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok {
+			return sub.SubImage(bounds)
+		}
+	}
+
+	width := int(math.Round(float64(bounds.Dx()) * v.Scale))
+	height := int(math.Round(float64(bounds.Dy()) * v.Scale))
+	scaled := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	var scaler xdraw.Scaler = xdraw.CatmullRom
+	if v.Scaler == "nearest" || v.Scaler == "auto" && v.Scale >= 1 && v.Scale == math.Trunc(v.Scale) {
+		// Whole number scales keep single pixel traces and text crisp
+		scaler = xdraw.NearestNeighbor
+	}
+	scaler.Scale(scaled, scaled.Bounds(), img, bounds, xdraw.Src, nil)
+	return scaled
+}
+
+// variantT is an additional output image, derived from the same annotated capture.
+type variantT struct {
+	Suffix string
+	View   viewT
+}
+
+// variantsFlag collects repeated `-variant SUFFIX=REGION[@SCALE]` command line arguments.
+type variantsFlag []variantT
+
+func (v *variantsFlag) String() string {
+	items := []string{}
+	for _, variant := range *v {
+		items = append(items, variant.Suffix+"="+variant.View.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (v *variantsFlag) Set(value string) error {
+	suffix, spec, found := strings.Cut(value, "=")
+	if !found || suffix == "" || suffix != makeFilenameSafe(suffix) || strings.Contains(suffix, "@") {
+		return fmt.Errorf("variant %q is not of the form SUFFIX=REGION[@SCALE]", value)
+	}
+	view, err := parseView(spec)
+	if err != nil {
+		return err
+	}
+	if err := checkView(view); err != nil {
+		return err
+	}
+	*v = append(*v, variantT{Suffix: suffix, View: view})
+	return nil
+}
+
+// variantPath returns the path of a variant of the image at path, e.g. "shot.png" ->
+// "shot@thumb.png".
+func variantPath(path, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "@" + suffix + ext
+}
+
+// isVariant returns whether the image at path, whose metadata is record, is a variant. Variants
+// share their capture's metadata, which lists them.
+func isVariant(record captureRecordT, path string) bool {
+	for _, variant := range record.Variants {
+		if variant == filepath.Base(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// waveformT is the displayed trace of one channel, as read with :WAV:DATA? in NORMal mode.
+type waveformT struct {
+	Source string
+	// XIncrement is the time between points (s) and XOrigin the time of the first point
+	XIncrement float64
+	XOrigin    float64
+	Volts      []float64
+}
+
+// displayedChannels returns the analog channels for which settings were recorded, i.e. those
+// displayed when the capture was made.
+func displayedChannels(settings map[string]string) []string {
+	channels := []string{}
+	for channel := 1; channel <= maxAnalogChannel; channel++ {
+		if _, ok := settings[fmt.Sprintf("ch%d_scale", channel)]; ok {
+			channels = append(channels, fmt.Sprintf("CH%d", channel))
+		}
+	}
+	return channels
+}
+
+// readWaveform reads the displayed waveform of a canonical analog source (e.g. "CH1").
+func readWaveform(conn net.Conn, source string) (waveformT, error) {
+	waveform := waveformT{Source: source}
+	scpiSource := "CHAN" + strings.TrimPrefix(source, "CH")
+	for _, scpi := range []string{":WAV:SOUR " + scpiSource, ":WAV:MODE NORM", ":WAV:FORM BYTE"} {
+		if err := send(conn, scpi); err != nil {
+			return waveform, err
+		}
+	}
+
+	// The preamble is format,type,points,count,xincrement,xorigin,xreference,yincrement,
+	// yorigin,yreference
+	preamble, err := command(conn, ":WAV:PRE?")
+	if err != nil {
+		return waveform, err
+	}
+	fields := strings.Split(preamble, ",")
+	if len(fields) != 10 {
+		return waveform, fmt.Errorf("unexpected waveform preamble %q", preamble)
+	}
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return waveform, fmt.Errorf("unexpected waveform preamble %q", preamble)
+		}
+	}
+	waveform.XIncrement, waveform.XOrigin = values[4], values[5]
+	xReference, yIncrement, yOrigin, yReference := values[6], values[7], values[8], values[9]
+	waveform.XOrigin -= xReference * waveform.XIncrement
+
+	data, err := queryTMCBlock(conn, ":WAV:DATA?")
+	if err != nil {
+		return waveform, err
+	}
+	if points := int(values[2]); len(data) != points {
+		return waveform, fmt.Errorf("read %d waveform points, expected %d", len(data), points)
+	}
+	for _, b := range data {
+		waveform.Volts = append(waveform.Volts, (float64(b)-yOrigin-yReference)*yIncrement)
+	}
+	return waveform, nil
+}
+
+// readWaveforms reads the waveforms of the given canonical sources.
+func readWaveforms(conn net.Conn, sources []string) ([]waveformT, error) {
+	log.InfoPrintf("Reading waveforms (%s)...", strings.Join(sources, ", "))
+	waveforms := []waveformT{}
+	for _, source := range sources {
+		waveform, err := readWaveform(conn, source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s waveform: %w", source, err)
+		}
+		waveforms = append(waveforms, waveform)
+	}
+	return waveforms, nil
+}
+
+// waveformCSV formats waveforms as CSV, one row per point with a time column followed by a
+// column per source. The time base is taken from the first waveform, since in NORMal mode every
+// channel shares it.
+func waveformCSV(waveforms []waveformT) []byte {
+	var b bytes.Buffer
+	b.WriteString("time_s")
+	points := 0
+	for _, waveform := range waveforms {
+		fmt.Fprintf(&b, ",%s_V", waveform.Source)
+		points = max(points, len(waveform.Volts))
+	}
+	b.WriteString("\n")
+	for i := 0; i < points; i++ {
+		b.WriteString(strconv.FormatFloat(waveforms[0].XOrigin+float64(i)*waveforms[0].XIncrement, 'g', 6, 64))
+		for _, waveform := range waveforms {
+			b.WriteString(",")
+			if i < len(waveform.Volts) {
+				b.WriteString(strconv.FormatFloat(waveform.Volts[i], 'g', 6, 64))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// waveformPath returns the path of the waveform CSV which accompanies an image.
+func waveformPath(imagePath string) string {
+	return strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".csv"
+}
+
+// writeWaveforms writes waveforms as the CSV which accompanies imagePath, and returns its path.
+func writeWaveforms(imagePath string, waveforms []waveformT) (string, error) {
+	path := waveformPath(imagePath)
+	if err := writeFileAtomic(path, waveformCSV(waveforms)); err != nil {
+		return "", err
+	}
+	log.InfoPrintf("Wrote waveforms to %q.", path)
+	return path, nil
+}
@@ -5,4 +5,5 @@ go 1.21
 require (
 	golang.org/x/image v0.23.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -57,6 +57,8 @@ type ConfigT struct {
 	MaxAge int
 	// Min LogLevel to log
 	Level LogLevel
+	// Console is where the *Print* functions echo messages (defaults to os.Stdout)
+	Console io.Writer
 }
 
 func (c *ConfigT) SetDefaults() {
@@ -66,10 +68,14 @@ func (c *ConfigT) SetDefaults() {
 	if c.MaxSize == 0 {
 		c.MaxSize = defaultMaxSize
 	}
+	if c.Console == nil {
+		c.Console = os.Stdout
+	}
 }
 
 type LoggerT struct {
 	RollingFile io.Writer
+	Console     io.Writer
 	Level       LogLevel
 }
 
@@ -83,6 +89,7 @@ func ConfigureLogger(config ConfigT) *LoggerT {
 	}
 	logger := &LoggerT{
 		RollingFile: rollingFile,
+		Console:     config.Console,
 		Level:       config.Level,
 	}
 	logger.Info("---------------------------- BEGIN ----------------------------")
@@ -114,7 +121,7 @@ func (log LoggerT) Infof(format string, a ...interface{}) {
 }
 
 func (log LoggerT) InfoPrint(msg string) {
-	fmt.Println(msg)
+	fmt.Fprintln(log.Console, msg)
 	log.Info(msg)
 }
 
@@ -132,7 +139,7 @@ func (log LoggerT) Errorf(format string, a ...interface{}) {
 }
 
 func (log LoggerT) ErrorPrint(msg string) {
-	fmt.Println("ERROR: " + msg)
+	fmt.Fprintln(log.Console, "ERROR: "+msg)
 	log.Error(msg)
 }
 